@@ -0,0 +1,183 @@
+package configmapinjector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// maxTargetSize is the maximum total size of the keys and values of a target,
+// the size limit of a ConfigMap or Secret.
+const maxTargetSize = 1024 * 1024
+
+var keyNamePattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+// getBinaryData returns the decoded binaryData of an inject source. Keys with
+// the gzip option are compressed.
+func (i *ConfigMapInjector) getBinaryData(source *yaml.RNode, options map[string]KeyOptions) (map[string][]byte, error) {
+	node, err := source.Pipe(yaml.Lookup(yaml.BinaryDataField))
+	if err != nil || node == nil {
+		return nil, err
+	}
+	if node.YNode().Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s must be a map", yaml.BinaryDataField)
+	}
+	data := source.GetDataMap()
+	binaryData := map[string][]byte{}
+	for key, val := range source.GetBinaryDataMap() {
+		path := fmt.Sprintf("%s.%s", yaml.BinaryDataField, key)
+		if _, ok := data[key]; ok {
+			return nil, &fieldError{
+				Path: path,
+				Err:  fmt.Errorf("key %q is set in both %s and %s", key, yaml.DataField, yaml.BinaryDataField),
+			}
+		}
+		decoded, err := base64.StdEncoding.DecodeString(val)
+		if err != nil {
+			return nil, &fieldError{Path: path, Err: fmt.Errorf("invalid base64: %w", err)}
+		}
+		if options[key].Gzip {
+			if decoded, err = compress(decoded); err != nil {
+				return nil, fmt.Errorf("%s.%s: %w", yaml.BinaryDataField, key, err)
+			}
+		}
+		binaryData[key] = decoded
+	}
+	return binaryData, nil
+}
+
+// compressData moves the keys of data with the gzip option to binaryData,
+// compressed. The keys of data must not be in binaryData.
+func compressData(data map[string]string, binaryData map[string][]byte, options map[string]KeyOptions) (map[string][]byte, error) {
+	for _, key := range yaml.SortedMapKeys(data) {
+		if !options[key].Gzip {
+			continue
+		}
+		compressed, err := compress([]byte(data[key]))
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", yaml.DataField, key, err)
+		}
+		if binaryData == nil {
+			binaryData = map[string][]byte{}
+		}
+		binaryData[key] = compressed
+		delete(data, key)
+	}
+	return binaryData, nil
+}
+
+// compress gzips content. The gzip header has no timestamp, so the result only
+// depends on content.
+func compress(content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setBinaryData writes binary data into the binaryData field of a ConfigMap,
+// or the data field of a Secret, removing the same keys from the other fields
+// so that a key is only set once.
+func setBinaryData(target *yaml.RNode, binaryData map[string][]byte) error {
+	if len(binaryData) == 0 {
+		return nil
+	}
+	if target.GetKind() == kindSecret {
+		encoded := target.GetDataMap()
+		stringData, err := getStringData(target)
+		if err != nil {
+			return err
+		}
+		for key, val := range binaryData {
+			encoded[key] = base64.StdEncoding.EncodeToString(val)
+			delete(stringData, key)
+		}
+		target.SetDataMap(encoded)
+		return setStringData(target, stringData)
+	}
+
+	data := target.GetDataMap()
+	encoded := target.GetBinaryDataMap()
+	moved := false
+	for key, val := range binaryData {
+		encoded[key] = base64.StdEncoding.EncodeToString(val)
+		if _, ok := data[key]; ok {
+			delete(data, key)
+			moved = true
+		}
+	}
+	if moved {
+		target.SetDataMap(data)
+	}
+	target.SetBinaryDataMap(encoded)
+	return nil
+}
+
+// checkKeyNames returns the field path and message of the first key that
+// isn't a valid ConfigMap or Secret key.
+func checkKeyNames(field string, keys []string) (string, string) {
+	for _, key := range keys {
+		if !keyNamePattern.MatchString(key) {
+			return fmt.Sprintf("%s.%s", field, key), fmt.Sprintf("invalid key name %q, must match %s", key, keyNamePattern)
+		}
+	}
+	return "", ""
+}
+
+// checkTarget returns the field path and message of the first violation of
+// the target's limits: a key set in both data and binaryData, or a total size
+// over maxTargetSize.
+func checkTarget(target *yaml.RNode) (string, string, error) {
+	data := target.GetDataMap()
+	binaryData := target.GetBinaryDataMap()
+	for _, key := range yaml.SortedMapKeys(binaryData) {
+		if _, ok := data[key]; ok {
+			return fmt.Sprintf("%s.%s", yaml.BinaryDataField, key),
+				fmt.Sprintf("key %q is set in both %s and %s of %s %s",
+					key, yaml.DataField, yaml.BinaryDataField, target.GetKind(), target.GetName()),
+				nil
+		}
+	}
+
+	stringData, err := getStringData(target)
+	if err != nil {
+		return "", "", err
+	}
+	size := 0
+	for _, m := range []map[string]string{data, binaryData, stringData} {
+		for key, val := range m {
+			size += len(key) + len(val)
+		}
+	}
+	// binaryData and the data of Secrets are stored decoded
+	size -= encodedOverhead(binaryData)
+	if target.GetKind() == kindSecret {
+		size -= encodedOverhead(data)
+	}
+	if size > maxTargetSize {
+		return yaml.DataField,
+			fmt.Sprintf("%s %s is %d bytes, over the limit of %d bytes",
+				target.GetKind(), target.GetName(), size, maxTargetSize),
+			nil
+	}
+	return "", "", nil
+}
+
+// encodedOverhead returns the difference between the size of the base64
+// encoded values and their decoded size.
+func encodedOverhead(m map[string]string) int {
+	overhead := 0
+	for _, val := range m {
+		overhead += len(val) - base64.StdEncoding.DecodedLen(len(val))
+	}
+	return overhead
+}
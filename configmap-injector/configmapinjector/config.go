@@ -0,0 +1,135 @@
+package configmapinjector
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const kindInjectorConfig = "ConfigMapInjector"
+
+// ConflictPolicy controls what happens when multiple sources write the same
+// key into the same target ConfigMap.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyError fails the function when a conflict is detected.
+	ConflictPolicyError ConflictPolicy = "error"
+	// ConflictPolicyWarn lets the last source win and reports a warning.
+	ConflictPolicyWarn ConflictPolicy = "warn"
+	// ConflictPolicyLastWins silently lets the last source win.
+	ConflictPolicyLastWins ConflictPolicy = "lastWins"
+)
+
+// New returns a ConfigMapInjector configured by the given functionConfig. The
+// functionConfig may be nil, a ConfigMap or a ConfigMapInjector resource. An
+// empty functionConfig or one of another kind, like the resource holding the
+// function annotation that kustomize passes, is ignored.
+func New(fnconfig *yaml.RNode) (*ConfigMapInjector, error) {
+	injector := &ConfigMapInjector{}
+	if fnconfig.IsNilOrEmpty() {
+		return injector, nil
+	}
+
+	meta, err := fnconfig.GetMeta()
+	if err != nil {
+		return nil, errors.New("unable to get resource meta from functionConfig")
+	}
+
+	switch {
+	case validGVK(meta, apiVersionConfigMap, kindConfigMap):
+		err = unmarshalConfig(injector, fnconfig, "data")
+	case validGVK(meta, apiVersionInjector, kindInjectorConfig):
+		err = unmarshalConfig(injector, fnconfig, "")
+	default:
+		return injector, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := injector.validate(); err != nil {
+		return nil, err
+	}
+	return injector, nil
+}
+
+func (i *ConfigMapInjector) validate() error {
+	switch i.ConflictPolicy {
+	case "", ConflictPolicyError, ConflictPolicyWarn, ConflictPolicyLastWins:
+	default:
+		return fmt.Errorf(
+			"conflictPolicy must be one of %q, %q or %q, got %q",
+			ConflictPolicyError, ConflictPolicyWarn, ConflictPolicyLastWins, i.ConflictPolicy,
+		)
+	}
+	if i.DiffMaxBytes < 0 {
+		return fmt.Errorf("diffMaxBytes must not be negative, got %d", i.DiffMaxBytes)
+	}
+	return validateNamespaceMatching(i.NamespaceMatching)
+}
+
+func (i *ConfigMapInjector) conflictPolicy() ConflictPolicy {
+	if i.ConflictPolicy == "" {
+		return ConflictPolicyWarn
+	}
+	return i.ConflictPolicy
+}
+
+func (i *ConfigMapInjector) diffMaxBytes() int {
+	if i.DiffMaxBytes == 0 {
+		return defaultDiffMaxBytes
+	}
+	return i.DiffMaxBytes
+}
+
+func validGVK(meta yaml.ResourceMeta, apiVersion, kind string) bool {
+	if meta.APIVersion != apiVersion || meta.Kind != kind {
+		return false
+	}
+	return true
+}
+
+func unmarshalConfig(i *ConfigMapInjector, rn *yaml.RNode, field string) error {
+	node := rn
+
+	if field != "" {
+		spec := rn.Field(field)
+		if spec == nil {
+			return nil
+		}
+		node = spec.Value.Copy()
+		unquoteScalars(node)
+	}
+
+	yamlstr, err := node.String()
+	if err != nil {
+		return fmt.Errorf("unable to get yaml from functionConfig: %w", err)
+	}
+
+	if err := yaml.Unmarshal([]byte(yamlstr), i); err != nil {
+		return fmt.Errorf("unable to unmarshal functionConfig: %w", err)
+	}
+	return nil
+}
+
+// unquoteScalars lets the string values of a ConfigMap set boolean and integer
+// fields, like diff: "true", by resolving the tags of values that parse as
+// booleans or integers.
+func unquoteScalars(data *yaml.RNode) {
+	content := data.YNode().Content
+	for idx := 1; idx < len(content); idx += 2 {
+		val := content[idx]
+		if val.Kind != yaml.ScalarNode || val.Tag != yaml.NodeTagString {
+			continue
+		}
+		_, boolErr := strconv.ParseBool(val.Value)
+		_, intErr := strconv.Atoi(val.Value)
+		if boolErr == nil || intErr == nil {
+			val.Tag = ""
+			val.Style = 0
+		}
+	}
+}
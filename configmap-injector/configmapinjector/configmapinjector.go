@@ -2,12 +2,12 @@ package configmapinjector
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 
-	"sigs.k8s.io/kustomize/api/konfig"
 	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
@@ -19,6 +19,7 @@ const (
 	kindInject          = "ConfigMapInject"
 	kindTemplate        = "ConfigMapTemplate"
 	kindConfigMap       = "ConfigMap"
+	fieldOrder          = "order"
 	configMapTemplate   = `apiVersion: v1
 kind: ConfigMap
 metadata:
@@ -26,43 +27,216 @@ metadata:
 `
 )
 
-type injector func(source, target *yaml.RNode) (*yaml.RNode, error)
+// sourceKinds lists the source kinds in the order they are processed when
+// sources share the same order value.
+var sourceKinds = []string{kindInject, kindSecretInject, kindTemplate, kindSecretTemplate, kindPatch}
+
+// targetKinds maps each source kind to the kind of resource it targets.
+var targetKinds = map[string]string{
+	kindInject:         kindConfigMap,
+	kindTemplate:       kindConfigMap,
+	kindSecretInject:   kindSecret,
+	kindSecretTemplate: kindSecret,
+	kindPatch:          kindConfigMap,
+}
+
+// injector injects a source into a target, returning the target and the
+// result of the injection.
+type injector func(ctx *renderContext, source, target *yaml.RNode) (*yaml.RNode, *injectResult, error)
 
 type injectResult struct {
 	Source   *yaml.RNode
 	Target   *yaml.RNode
 	Keys     []string
 	ErrorMsg string
+	// ErrorPath is the path of the field of the source that caused the error
+	ErrorPath string
+	// Reported is set when the error is already reported by other results,
+	// like the schema errors of the values
+	Reported bool
+	// Merged are the keys merged into existing values rather than replacing
+	// them
+	Merged map[string]bool
+	// ValueOrigins records the layer that supplied each template value
+	ValueOrigins map[string]string
+	// Changes sorts the keys by how their values changed, unless the
+	// injection failed
+	Changes *keyChanges
+}
+
+// reportedError is an error already reported by the result of an injector.
+type reportedError struct {
+	error
+}
+
+func (e *reportedError) Unwrap() error {
+	return e.error
+}
+
+// fieldError is an error in the field of a source at Path, like data.<key> or
+// values.
+type fieldError struct {
+	Path string
+	Err  error
+}
+
+func (e *fieldError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.Err
+}
+
+// errorPath returns the path of the field of the source that caused err, or
+// an empty string if it isn't known.
+func errorPath(err error) string {
+	var fieldErr *fieldError
+	if errors.As(err, &fieldErr) {
+		return fieldErr.Path
+	}
+	var sourceErr *sourceError
+	if errors.As(err, &sourceErr) {
+		return sourceErr.Path
+	}
+	return ""
+}
+
+// sourceError is an error in the field of a source at Path.
+type sourceError struct {
+	Source  *yaml.RNode
+	Path    string
+	Message string
+}
+
+func (e *sourceError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+type keyConflict struct {
+	Key      string
+	Previous *yaml.RNode
+	Source   *yaml.RNode
+	Target   *yaml.RNode
+	Severity framework.Severity
 }
 
 type ConfigMapInjector struct {
+	ConflictPolicy ConflictPolicy `json:"conflictPolicy,omitempty" yaml:"conflictPolicy,omitempty"`
+	// Values override the values of all template sources
+	Values map[string]interface{} `json:"values,omitempty" yaml:"values,omitempty"`
+	// Profile is the active profile of all sources
+	Profile string `json:"profile,omitempty" yaml:"profile,omitempty"`
+	// NamespaceMatching is the default namespace matching mode of all sources
+	NamespaceMatching NamespaceMatching `json:"namespaceMatching,omitempty" yaml:"namespaceMatching,omitempty"`
+	// Diff adds the unified diff of the changed keys to the results
+	Diff bool `json:"diff,omitempty" yaml:"diff,omitempty"`
+	// DiffMaxBytes is the size diffs are truncated to
+	DiffMaxBytes int `json:"diffMaxBytes,omitempty" yaml:"diffMaxBytes,omitempty"`
+
 	injectResults []*injectResult
+	conflicts     []*keyConflict
+	// owners tracks which source last wrote each key of each target
+	owners map[string]map[string]*yaml.RNode
+	// hashed tracks the targets that get a hash suffix appended to their name
+	hashed map[string]bool
+	// generated tracks the targets generated by the function
+	generated map[string]bool
+	renames   []*renameResult
+	prunes    []*pruneResult
+	patches   []*patchResult
+	// skipped are the disabled sources
+	skipped []*yaml.RNode
+	// schemaErrors are the template values that don't match their schema
+	schemaErrors []*schemaError
+	// sourceErrors are errors in a field of a source
+	sourceErrors []*sourceError
+	// failed is set when a source failed, in which case no output is written
+	failed bool
+	// inputValues are the values of the targets in the input, by target id
+	inputValues map[string]map[string]string
+	// emptyForEach are the sources whose forEach list is empty
+	emptyForEach []*emptyForEach
 }
 
 func (i *ConfigMapInjector) Filter(items []*yaml.RNode) ([]*yaml.RNode, error) {
 	injectors := map[string]injector{
-		kindInject:   i.injectConfigMap,
-		kindTemplate: i.templateConfigMap,
+		kindInject:         i.injectData,
+		kindTemplate:       i.templateData,
+		kindSecretInject:   i.injectData,
+		kindSecretTemplate: i.templateData,
+		kindPatch:          i.patchData,
 	}
-	var err error
-	for kind, injector := range injectors {
-		items, err = i.inject(items, kindSelector(kind), injector)
-		if err != nil {
-			return items, err
+	sources, orderErrs, err := sortedSources(items)
+	if err != nil {
+		return items, err
+	}
+	if i.inputValues, err = inputValues(items); err != nil {
+		return items, err
+	}
+	// keep processing the remaining sources when a source fails so that all
+	// failures are reported
+	var failures []string
+	for _, source := range sources {
+		err := orderErrs[source]
+		if err == nil {
+			items, err = i.injectSource(items, source, injectors[source.GetKind()])
+		}
+		if err == nil {
+			continue
+		}
+		var reported *reportedError
+		if !errors.As(err, &reported) {
+			i.sourceErrors = append(i.sourceErrors, &sourceError{
+				Source:  source,
+				Path:    errorPath(err),
+				Message: err.Error(),
+			})
 		}
+		failures = append(failures, err.Error())
+	}
+	i.failed = len(failures) > 0
+	switch {
+	case len(failures) == 1:
+		return items, errors.New(failures[0])
+	case len(failures) > 1:
+		// pruning would remove the keys of the sources that failed
+		return items, fmt.Errorf("%d sources failed: %s", len(failures), strings.Join(failures, "; "))
+	}
+
+	if err := i.pruneTargets(items); err != nil {
+		return items, err
+	}
+	if err := i.hashTargets(items); err != nil {
+		return items, err
 	}
 	return items, nil
 }
 
+// injectSource applies the active profile to a source and injects it, unless
+// it is disabled.
+func (i *ConfigMapInjector) injectSource(items []*yaml.RNode, source *yaml.RNode, injector injector) ([]*yaml.RNode, error) {
+	source, err := applyProfile(source, i.Profile)
+	if err != nil {
+		return items, err
+	}
+	enabled, err := sourceEnabled(source)
+	if err != nil {
+		return items, err
+	}
+	if !enabled {
+		i.skipped = append(i.skipped, source)
+		return items, nil
+	}
+	return i.inject(items, source, injector)
+}
+
 func (i *ConfigMapInjector) Results() (framework.Results, error) {
 	var results framework.Results
-	if len(i.injectResults) == 0 {
-		results = append(results, &framework.Result{
-			Message: "no injections",
-		})
-		return results, nil
-	}
 	for _, injectResult := range i.injectResults {
+		if injectResult.Reported {
+			continue
+		}
 		var (
 			msg        string
 			severity   framework.Severity
@@ -70,10 +244,26 @@ func (i *ConfigMapInjector) Results() (framework.Results, error) {
 			targetName = injectResult.Target.GetName()
 		)
 		if injectResult.ErrorMsg != "" {
-			msg = fmt.Sprintf("%s failed to inject ConfigMap: %s", sourceName, injectResult.ErrorMsg)
+			msg = fmt.Sprintf("%s failed to inject %s: %s", sourceName, injectResult.Target.GetKind(), injectResult.ErrorMsg)
 			severity = framework.Error
 		} else {
 			msg = fmt.Sprintf("%s -> %s with keys: %v", sourceName, targetName, injectResult.Keys)
+			if len(injectResult.ValueOrigins) > 0 {
+				origins := make([]string, 0, len(injectResult.ValueOrigins))
+				for _, path := range yaml.SortedMapKeys(injectResult.ValueOrigins) {
+					origins = append(origins, fmt.Sprintf("%s from %s", path, injectResult.ValueOrigins[path]))
+				}
+				msg = fmt.Sprintf("%s, values: %s", msg, strings.Join(origins, ", "))
+			}
+			if changes := injectResult.Changes; changes != nil {
+				msg = fmt.Sprintf("%s (%s)", msg, changes)
+				if i.Diff && changes.Diff != "" {
+					msg = fmt.Sprintf("%s\n%s", msg, truncateDiff(changes.Diff, i.diffMaxBytes()))
+				}
+			}
+			if i.failed {
+				msg = fmt.Sprintf("%s, not written because the run failed", msg)
+			}
 			severity = framework.Info
 		}
 
@@ -84,82 +274,516 @@ func (i *ConfigMapInjector) Results() (framework.Results, error) {
 				Path: strings.Join(injectResult.Target.FieldPath(), "."),
 			},
 		}
+		// failures point at the source
+		resultNode := injectResult.Target
+		if injectResult.ErrorMsg != "" {
+			resultNode = injectResult.Source
+			result.ResourceRef = resourceRef(injectResult.Source)
+			result.Field = nil
+			if injectResult.ErrorPath != "" {
+				result.Field = &framework.Field{
+					Path: injectResult.ErrorPath,
+				}
+			}
+		}
+
+		// the files of targets don't exist when the run failed
+		if i.failed && injectResult.ErrorMsg == "" {
+			result.Field = nil
+			results = append(results, result)
+			continue
+		}
+
+		file, err := resultFile(resultNode)
+		if err != nil {
+			return results, err
+		}
+		result.File = file
+
+		results = append(results, result)
+	}
+	for _, conflict := range i.conflicts {
+		result := &framework.Result{
+			Message:     conflict.message(),
+			Severity:    conflict.Severity,
+			ResourceRef: resourceRef(conflict.Source),
+			Field: &framework.Field{
+				Path: "data." + conflict.Key,
+			},
+		}
 
-		filePath, fileIndex, err := kioutil.GetFileAnnotations(injectResult.Target)
+		file, err := resultFile(conflict.Source)
 		if err != nil {
 			return results, err
 		}
-		result.File = &framework.File{
-			Path: filePath,
+		result.File = file
+
+		results = append(results, result)
+	}
+	for _, prune := range i.prunes {
+		result := &framework.Result{
+			Message: fmt.Sprintf(
+				"pruned keys no longer provided by any source from %s %s: %v",
+				prune.Target.GetKind(), prune.Target.GetName(), prune.Keys,
+			),
+			Severity: framework.Info,
 		}
-		fidx, err := strconv.Atoi(fileIndex)
-		if err == nil {
-			result.File.Index = fidx
+
+		file, err := resultFile(prune.Target)
+		if err != nil {
+			return results, err
 		}
+		result.File = file
 
 		results = append(results, result)
 	}
+	for _, rename := range i.renames {
+		result := &framework.Result{
+			Message: fmt.Sprintf(
+				"%s %s renamed to %s, updated references in %d resources",
+				rename.Target.GetKind(), rename.OldName, rename.Target.GetName(), len(rename.References),
+			),
+			Severity: framework.Info,
+			Field: &framework.Field{
+				Path:          "metadata.name",
+				CurrentValue:  rename.OldName,
+				ProposedValue: rename.Target.GetName(),
+			},
+		}
+
+		file, err := resultFile(rename.Target)
+		if err != nil {
+			return results, err
+		}
+		result.File = file
+
+		results = append(results, result)
+	}
+	for _, schemaErr := range i.schemaErrors {
+		result := &framework.Result{
+			Message:     fmt.Sprintf("%s %s", schemaErr.Path, schemaErr.Message),
+			Severity:    framework.Error,
+			ResourceRef: resourceRef(schemaErr.Source),
+			Field: &framework.Field{
+				Path: schemaErr.Path,
+			},
+		}
+
+		file, err := resultFile(schemaErr.Source)
+		if err != nil {
+			return results, err
+		}
+		result.File = file
+
+		results = append(results, result)
+	}
+	for _, empty := range i.emptyForEach {
+		result := &framework.Result{
+			Message: fmt.Sprintf(
+				"%s %s: %s list values.%s is empty, nothing rendered",
+				empty.Source.GetKind(), empty.Source.GetName(), fieldForEach, empty.Values,
+			),
+			Severity:    framework.Warning,
+			ResourceRef: resourceRef(empty.Source),
+			Field: &framework.Field{
+				Path: fieldForEach,
+			},
+		}
+
+		file, err := resultFile(empty.Source)
+		if err != nil {
+			return results, err
+		}
+		result.File = file
+
+		results = append(results, result)
+	}
+	for _, source := range i.skipped {
+		result := &framework.Result{
+			Message:     fmt.Sprintf("%s %s is disabled, skipped", source.GetKind(), source.GetName()),
+			Severity:    framework.Info,
+			ResourceRef: resourceRef(source),
+			Field: &framework.Field{
+				Path: fieldEnabled,
+			},
+		}
+
+		file, err := resultFile(source)
+		if err != nil {
+			return results, err
+		}
+		result.File = file
+
+		results = append(results, result)
+	}
+	for _, sourceErr := range i.sourceErrors {
+		result := &framework.Result{
+			Message:     sourceErr.Message,
+			Severity:    framework.Error,
+			ResourceRef: resourceRef(sourceErr.Source),
+		}
+		if sourceErr.Path != "" {
+			result.Field = &framework.Field{
+				Path: sourceErr.Path,
+			}
+		}
+
+		file, err := resultFile(sourceErr.Source)
+		if err != nil {
+			return results, err
+		}
+		result.File = file
+
+		results = append(results, result)
+	}
+	for _, patch := range i.patches {
+		result := &framework.Result{
+			Message:     patch.message(),
+			Severity:    framework.Info,
+			ResourceRef: resourceRef(patch.Source),
+			Field: &framework.Field{
+				Path: fmt.Sprintf("%s[%d]", fieldOperations, patch.Index),
+			},
+		}
+
+		file, err := resultFile(patch.Source)
+		if err != nil {
+			return results, err
+		}
+		result.File = file
+
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		results = append(results, &framework.Result{
+			Message: "no injections",
+		})
+	}
 	return results, nil
 }
 
-func (i *ConfigMapInjector) inject(items []*yaml.RNode, selector framework.Selector, injector injector) ([]*yaml.RNode, error) {
-	sources, err := selector.Filter(items)
+func resourceRef(node *yaml.RNode) *yaml.ResourceIdentifier {
+	return &yaml.ResourceIdentifier{
+		TypeMeta: yaml.TypeMeta{
+			APIVersion: node.GetApiVersion(),
+			Kind:       node.GetKind(),
+		},
+		NameMeta: yaml.NameMeta{
+			Name:      node.GetName(),
+			Namespace: node.GetNamespace(),
+		},
+	}
+}
+
+func (c *keyConflict) message() string {
+	return fmt.Sprintf(
+		"key %q in %s %s is set by both %s and %s",
+		c.Key, c.Target.GetKind(), c.Target.GetName(), sourceDescription(c.Previous), sourceDescription(c.Source),
+	)
+}
+
+func sourceDescription(source *yaml.RNode) string {
+	desc := fmt.Sprintf("%s %s", source.GetKind(), source.GetName())
+	path, index, err := kioutil.GetFileAnnotations(source)
+	if err == nil && path != "" {
+		desc = fmt.Sprintf("%s (%s[%s])", desc, path, index)
+	}
+	return desc
+}
+
+func resultFile(node *yaml.RNode) (*framework.File, error) {
+	filePath, fileIndex, err := kioutil.GetFileAnnotations(node)
+	if err != nil {
+		return nil, err
+	}
+	file := &framework.File{
+		Path: filePath,
+	}
+	fidx, err := strconv.Atoi(fileIndex)
+	if err == nil {
+		file.Index = fidx
+	}
+	return file, nil
+}
+
+func (i *ConfigMapInjector) inject(items []*yaml.RNode, source *yaml.RNode, injector injector) ([]*yaml.RNode, error) {
+	meta, err := getTargetMetadata(source)
 	if err != nil {
 		return items, err
 	}
-	sourceMap := map[*yaml.RNode]bool{}
-	for _, source := range sources {
-		sourceMap[source] = false
+	refs, err := getTargetRefs(source, meta)
+	if err != nil {
+		return items, err
+	}
+	kind := targetKinds[source.GetKind()]
+	hashSuffix, err := sourceBool(source, fieldHashSuffix, false)
+	if err != nil {
+		return items, err
+	}
+	behavior, err := sourceBehavior(source)
+	if err != nil {
+		return items, err
+	}
+	// patches only apply to existing targets
+	if source.GetKind() == kindPatch {
+		behavior = BehaviorMustExist
+	}
+	namespaceMatching, err := sourceNamespaceMatching(source, i.NamespaceMatching)
+	if err != nil {
+		return items, err
 	}
 
-	isConfigMap := framework.ResourceMatcherFunc(func(node *yaml.RNode) bool {
-		return node.GetKind() == kindConfigMap &&
+	isTargetKind := framework.ResourceMatcherFunc(func(node *yaml.RNode) bool {
+		return node.GetKind() == kind &&
 			node.GetApiVersion() == apiVersionConfigMap
 	})
 
-	isTarget := func(inject *yaml.RNode) framework.ResourceMatcherFunc {
-		return framework.MatchAll(
-			isConfigMap,
-			framework.ResourceMatcherFunc(func(node *yaml.RNode) bool {
-				return node.GetName() == inject.GetName() &&
-					node.GetNamespace() == inject.GetNamespace()
-			}),
-		).Match
-	}
-
-	// look for target configmaps and inject data
-	for i, item := range items {
-		for source := range sourceMap {
-			if isTarget(source)(item) {
-				sourceMap[source] = true
-				configMap, err := injector(source, item.Copy())
-				if err != nil {
-					return items, err
-				}
-				items[i] = configMap
+	// injectInto injects data into the existing target at idx
+	injectInto := func(ctx *renderContext, idx int) error {
+		item := items[idx]
+		id := targetID(kind, item.GetNamespace(), baseName(item))
+		if behavior == BehaviorCreate && !i.generated[id] {
+			// targets generated on an earlier run are part of the input
+			generated, err := managedOnly(item)
+			if err != nil {
+				return err
 			}
+			if !generated {
+				return fmt.Errorf(
+					"%s %s: %s %s already exists (behavior: %s)",
+					source.GetKind(), source.GetName(), kind, item.GetName(), behavior,
+				)
+			}
+		}
+		if hashSuffix {
+			i.hash(id)
 		}
+		target := item.Copy()
+		if behavior == BehaviorReplace {
+			if err := clearData(target, i.owners[id]); err != nil {
+				return err
+			}
+		}
+		if err := applyTargetMetadata(target, meta); err != nil {
+			return err
+		}
+		target, result, err := injector(ctx, source, target)
+		if err != nil {
+			return &reportedError{err}
+		}
+		items[idx] = target
+		return i.recordChanges(result, item, target)
+	}
+
+	elements, err := i.forEachElements(&renderContext{items: items}, source)
+	if err != nil {
+		return items, err
 	}
+	elementKeys := map[string]int{}
+
+	for _, element := range elements {
+		// each element sees the targets written by the previous elements
+		ctx := &renderContext{
+			items:       items,
+			element:     element,
+			elementKeys: elementKeys,
+		}
+		refs, err := i.renderTargetRefs(ctx, source, refs)
+		if err != nil {
+			return items, err
+		}
+		for _, ref := range refs {
+			if ref.LabelSelector != "" {
+				matched := false
+				for idx, item := range items {
+					if !isTargetKind.Match(item) || (ref.Namespace != "" && item.GetNamespace() != ref.Namespace) {
+						continue
+					}
+					ok, err := item.MatchesLabelSelector(ref.LabelSelector)
+					if err != nil {
+						return items, fmt.Errorf("%s %s: %w", source.GetKind(), source.GetName(), err)
+					}
+					if !ok {
+						continue
+					}
+					matched = true
+					if err := injectInto(ctx, idx); err != nil {
+						return items, err
+					}
+				}
+				if !matched {
+					return items, fmt.Errorf(
+						"%s %s: no %s matches labelSelector %q",
+						source.GetKind(), source.GetName(), kind, ref.LabelSelector,
+					)
+				}
+				continue
+			}
 
-	// if no injection occurred, generate a new configmap
-	for source, injected := range sourceMap {
-		if !injected {
-			configMap, err := newConfigMap(source)
+			// look for targets and inject data
+			var candidates []int
+			for idx, item := range items {
+				if isTargetKind.Match(item) && baseName(item) == ref.Name {
+					candidates = append(candidates, idx)
+				}
+			}
+			matches, err := matchNamespace(namespaceMatching, ref.Namespace, items, candidates)
+			if err != nil {
+				return items, fmt.Errorf("%s %s: %s %s %w", source.GetKind(), source.GetName(), kind, ref.Name, err)
+			}
+			for _, idx := range matches {
+				if err := injectInto(ctx, idx); err != nil {
+					return items, err
+				}
+			}
+			if len(matches) > 0 {
+				continue
+			}
+
+			// if no injection occurred, generate a new target
+			if behavior == BehaviorMustExist {
+				return items, fmt.Errorf(
+					"%s %s: %s %s not found (behavior: %s)",
+					source.GetKind(), source.GetName(), kind, ref.Name, behavior,
+				)
+			}
+			id := targetID(kind, ref.Namespace, ref.Name)
+			if i.generated == nil {
+				i.generated = map[string]bool{}
+			}
+			i.generated[id] = true
+			if hashSuffix {
+				i.hash(id)
+			}
+			target, err := newTarget(source, meta, ref.Name, ref.Namespace)
 			if err != nil {
 				return items, err
 			}
-			configMap, err = injector(source, configMap)
+			filePath, err := targetPath(source, ref, kind)
 			if err != nil {
 				return items, err
 			}
-
-			items = append(items, configMap)
+			if err := setFileAnnotations(target, items, filePath); err != nil {
+				return items, err
+			}
+			target, result, err := injector(ctx, source, target)
+			if err != nil {
+				return items, &reportedError{err}
+			}
+			if err := i.recordChanges(result, nil, target); err != nil {
+				return items, err
+			}
+			items = append(items, target)
 		}
 	}
 
 	return items, nil
 }
 
+// sortedSources returns all source resources in the order they should be
+// processed. Sources are ordered by their "order" field, then by kind (inject
+// kinds, then template kinds, then patches), then by file path and index.
+// Because later sources override keys written by earlier sources, the source
+// with the highest order wins.
+// Sources with an invalid order are returned, at order 0, along with their
+// error so that the other sources are still processed.
+func sortedSources(items []*yaml.RNode) ([]*yaml.RNode, map[*yaml.RNode]error, error) {
+	type sortKey struct {
+		order    int
+		kindRank int
+		path     string
+		index    int
+	}
+
+	var (
+		sources   []*yaml.RNode
+		keys      = map[*yaml.RNode]sortKey{}
+		orderErrs = map[*yaml.RNode]error{}
+	)
+	for rank, kind := range sourceKinds {
+		selector := kindSelector(kind)
+		nodes, err := selector.Filter(items)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, node := range nodes {
+			order, err := sourceOrder(node)
+			if err != nil {
+				orderErrs[node] = err
+			}
+			path, index, err := kioutil.GetFileAnnotations(node)
+			if err != nil {
+				return nil, nil, err
+			}
+			idx, _ := strconv.Atoi(index)
+			keys[node] = sortKey{
+				order:    order,
+				kindRank: rank,
+				path:     path,
+				index:    idx,
+			}
+			sources = append(sources, node)
+		}
+	}
+
+	sort.SliceStable(sources, func(i, j int) bool {
+		a, b := keys[sources[i]], keys[sources[j]]
+		switch {
+		case a.order != b.order:
+			return a.order < b.order
+		case a.kindRank != b.kindRank:
+			return a.kindRank < b.kindRank
+		case a.path != b.path:
+			return a.path < b.path
+		default:
+			return a.index < b.index
+		}
+	})
+	return sources, orderErrs, nil
+}
+
+// sourceOrder returns the value of the optional "order" field of a source.
+// The value may be an integer or a string holding an integer so that it can
+// be set with kpt setters.
+func sourceOrder(source *yaml.RNode) (int, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldOrder))
+	if err != nil {
+		return 0, err
+	}
+	if node == nil || node.YNode().Value == "" {
+		return 0, nil
+	}
+	order, err := strconv.Atoi(node.YNode().Value)
+	if err != nil {
+		return 0, &fieldError{
+			Path: fieldOrder,
+			Err:  fmt.Errorf("must be an integer, got %q", node.YNode().Value),
+		}
+	}
+	return order, nil
+}
+
+// sourceBool returns the value of an optional boolean field of a source. The
+// value may be a boolean or a string holding a boolean so that it can be set
+// with kpt setters.
+func sourceBool(source *yaml.RNode, field string, defaultValue bool) (bool, error) {
+	node, err := source.Pipe(yaml.Lookup(field))
+	if err != nil {
+		return false, err
+	}
+	if node == nil || node.YNode().Value == "" {
+		return defaultValue, nil
+	}
+	val, err := strconv.ParseBool(node.YNode().Value)
+	if err != nil {
+		return false, fmt.Errorf(
+			"%s %s: %s must be a boolean, got %q",
+			source.GetKind(), source.GetName(), field, node.YNode().Value,
+		)
+	}
+	return val, nil
+}
+
 func kindSelector(kind string) framework.Selector {
 	return framework.Selector{
 		Kinds:       []string{kind},
@@ -167,105 +791,335 @@ func kindSelector(kind string) framework.Selector {
 	}
 }
 
-func newConfigMap(inject *yaml.RNode) (*yaml.RNode, error) {
-	configMap, err := yaml.Parse(configMapTemplate)
+// newTarget generates the target ConfigMap or Secret of a source. Unless the
+// source has targetMetadata, the target inherits the source's labels and
+// annotations, minus annotations that only apply to the source and its file.
+func newTarget(inject *yaml.RNode, meta *TargetMetadata, name, namespace string) (*yaml.RNode, error) {
+	tmpl := configMapTemplate
+	if targetKinds[inject.GetKind()] == kindSecret {
+		tmpl = secretTemplate
+	}
+	target, err := yaml.Parse(tmpl)
 	if err != nil {
 		return nil, err
 	}
-	configMap.SetName(inject.GetName())
-	configMap.SetNamespace(inject.GetNamespace())
-	configMap.SetLabels(inject.GetLabels())
+	target.SetName(name)
+	target.SetNamespace(namespace)
 
-	annotations := inject.GetAnnotations()
-	delete(annotations, konfig.IgnoredByKustomizeAnnotation)
-	configMap.SetAnnotations(annotations)
+	if target.GetKind() == kindSecret {
+		typ, err := secretType(inject)
+		if err != nil {
+			return nil, err
+		}
+		if err := target.PipeE(yaml.SetField(fieldSecretType, yaml.NewStringRNode(typ))); err != nil {
+			return nil, err
+		}
+	}
 
-	return configMap, nil
+	if meta == nil {
+		target.SetLabels(inject.GetLabels())
+		target.SetAnnotations(inheritedAnnotations(inject))
+		return target, nil
+	}
+	if err := applyTargetMetadata(target, meta); err != nil {
+		return nil, err
+	}
+	return target, nil
 }
 
-func (i *ConfigMapInjector) injectConfigMap(source *yaml.RNode, configMap *yaml.RNode) (*yaml.RNode, error) {
-	result := newInjectResult(source, configMap)
+func (i *ConfigMapInjector) injectData(_ *renderContext, source *yaml.RNode, target *yaml.RNode) (*yaml.RNode, *injectResult, error) {
+	result := newInjectResult(source, target)
 	defer func() {
 		i.injectResults = append(i.injectResults, result)
 	}()
 
-	data, err := source.GetFieldValue("data")
+	format, err := sourceFormat(source)
 	if err != nil {
-		return configMap, err
+		result.fail(err)
+		return target, result, err
 	}
-	dataMap, ok := data.(map[string]interface{})
-	if !ok {
-		err = fmt.Errorf(
-			"data must be a map[string]interface, got %T",
-			data,
-		)
-		result.ErrorMsg = err.Error()
-		return configMap, err
+	comments, err := sourceCommentMode(source)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+	keyOptions, err := getKeyOptions(source)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+
+	binaryData, err := i.getBinaryData(source, keyOptions)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+	data, err := source.Pipe(yaml.Lookup(yaml.DataField))
+	if err != nil {
+		return target, result, err
+	}
+	if data == nil && binaryData != nil {
+		data = yaml.NewMapRNode(nil)
+	}
+	if data == nil || data.YNode().Kind != yaml.MappingNode {
+		err = errors.New("data must be a map")
+		result.fail(err)
+		return target, result, err
 	}
 	transformed := map[string]string{}
-	for key, val := range dataMap {
-		yml, err := yaml.Marshal(val)
+	err = data.VisitFields(func(node *yaml.MapNode) error {
+		key := node.Key.YNode().Value
+		keyFormat, keyComments := format, comments
+		opts := keyOptions[key]
+		if opts.Format != "" {
+			keyFormat = opts.Format
+		}
+		if opts.Comments != "" {
+			keyComments = opts.Comments
+		}
+		if opts.MergeStrategy == MergeStrategyDeepMerge || opts.MergeStrategy == MergeStrategyStrategicList {
+			existing, ok, err := existingValue(target, key)
+			if err != nil {
+				return &fieldError{Path: "data." + key, Err: err}
+			}
+			if ok && strings.TrimSpace(existing) != "" {
+				val, err := mergeValue(existing, node.Value, opts, keyComments)
+				if err != nil {
+					return &fieldError{Path: "data." + key, Err: err}
+				}
+				transformed[key] = val
+				result.Merged[key] = true
+				return nil
+			}
+		}
+		if keyFormat == "" {
+			keyFormat = defaultFormat(source, node.Value)
+		}
+		val, err := encode(keyFormat, keyComments, node.Value)
 		if err != nil {
-			result.ErrorMsg = err.Error()
-			return configMap, err
+			return &fieldError{Path: "data." + key, Err: err}
 		}
-		transformed[key] = string(yml)
+		transformed[key] = val
+		return nil
+	})
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+	if err := validateData(transformed, keyOptions); err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+	binaryData, err = compressData(transformed, binaryData, keyOptions)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
 	}
 
-	cmdata := configMap.GetDataMap()
-	for key, val := range transformed {
-		cmdata[key] = val
-		result.Keys = append(result.Keys, key)
+	if err := i.setData(result, transformed, binaryData); err != nil {
+		result.fail(err)
+		return target, result, err
 	}
-	configMap.SetDataMap(cmdata)
-	return configMap, nil
+	return target, result, nil
 }
 
-func (i *ConfigMapInjector) templateConfigMap(source *yaml.RNode, configMap *yaml.RNode) (*yaml.RNode, error) {
-	result := newInjectResult(source, configMap)
+func (i *ConfigMapInjector) templateData(ctx *renderContext, source *yaml.RNode, target *yaml.RNode) (*yaml.RNode, *injectResult, error) {
+	result := newInjectResult(source, target)
 	defer func() {
 		i.injectResults = append(i.injectResults, result)
 	}()
 
 	data := source.GetDataMap()
-
-	rawvals, err := source.GetFieldValue("values")
+	keyOptions, err := getKeyOptions(source)
 	if err != nil {
-		return configMap, err
+		result.fail(err)
+		return target, result, err
 	}
-	values, ok := rawvals.(map[string]interface{})
-	if !ok {
-		err = fmt.Errorf(
-			"values must be a map[string]interface{}, got %T",
-			rawvals,
-		)
-		result.ErrorMsg = err.Error()
-		return configMap, err
+
+	values, origins, err := i.templateValues(ctx, source)
+	if err != nil {
+		result.failAt(fieldValues, err)
+		return target, result, err
 	}
+	result.ValueOrigins = origins
 
-	rendered := map[string]string{}
-	for key, val := range data {
-		tmpl, err := template.New(key).Option("missingkey=error").Parse(val)
-		if err != nil {
-			return configMap, err
+	schema, err := getValuesSchema(source)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+	if schema != nil {
+		schema.applyDefaults(values, "", origins)
+		if errs := schema.validate(values, fieldValues); len(errs) > 0 {
+			msgs := make([]string, 0, len(errs))
+			for _, schemaErr := range errs {
+				schemaErr.Source = source
+				msgs = append(msgs, fmt.Sprintf("%s %s", schemaErr.Path, schemaErr.Message))
+			}
+			i.schemaErrors = append(i.schemaErrors, errs...)
+			err = fmt.Errorf("values don't match %s: %s", fieldValuesSchema, strings.Join(msgs, ", "))
+			// each schema error is reported on its own
+			result.failAt(fieldValues, err)
+			result.Reported = true
+			return target, result, err
 		}
+	}
+
+	nondeterministic, err := sourceBool(source, fieldNondeterministicFuncs, false)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+	funcs := templateFuncs(nondeterministic)
+	tmpl, err := parseTemplates(source, ctx.items, funcs)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
 
+	rendered := map[string]string{}
+	for _, key := range yaml.SortedMapKeys(data) {
 		var buf bytes.Buffer
-		err = tmpl.Execute(&buf, values)
+		err = tmpl.ExecuteTemplate(&buf, key, values)
 		if err != nil {
-			result.ErrorMsg = err.Error()
-			return configMap, err
+			result.failAt("data."+key, err)
+			return target, result, err
 		}
 		rendered[key] = buf.String()
 	}
+	rendered, keyOptions, err = i.renderKeys(ctx, target, rendered, keyOptions, values, funcs)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+	if err := validateData(rendered, keyOptions); err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+
+	binaryData, err := compressData(rendered, nil, keyOptions)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+
+	if err := i.setData(result, rendered, binaryData); err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+	return target, result, nil
+}
+
+// setData writes data and binary data into the result's target ConfigMap or
+// Secret, recording which source owns each key and handling keys already
+// written by another source according to the conflict policy. Invalid key
+// names and targets over their limits are reported as errors of the source.
+func (i *ConfigMapInjector) setData(result *injectResult, data map[string]string, binaryData map[string][]byte) error {
+	if path, msg := checkKeyNames(yaml.DataField, yaml.SortedMapKeys(data)); path != "" {
+		return &fieldError{Path: path, Err: errors.New(msg)}
+	}
+	binaryKeys := make([]string, 0, len(binaryData))
+	for key := range binaryData {
+		binaryKeys = append(binaryKeys, key)
+	}
+	sort.Strings(binaryKeys)
+	if path, msg := checkKeyNames(yaml.BinaryDataField, binaryKeys); path != "" {
+		return &fieldError{Path: path, Err: errors.New(msg)}
+	}
+
+	if i.owners == nil {
+		i.owners = map[string]map[string]*yaml.RNode{}
+	}
+	id := targetID(result.Target.GetKind(), result.Target.GetNamespace(), baseName(result.Target))
+	owners, ok := i.owners[id]
+	if !ok {
+		owners = map[string]*yaml.RNode{}
+		i.owners[id] = owners
+	}
+
+	keys := make([]string, 0, len(data)+len(binaryData))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	keys = append(keys, binaryKeys...)
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		previous, ok := owners[key]
+		if !ok || previous == result.Source || result.Merged[key] {
+			continue
+		}
+		conflict := &keyConflict{
+			Key:      key,
+			Previous: previous,
+			Source:   result.Source,
+			Target:   result.Target,
+		}
+		switch i.conflictPolicy() {
+		case ConflictPolicyError:
+			conflict.Severity = framework.Error
+			i.conflicts = append(i.conflicts, conflict)
+			// the conflict is reported on its own, with the key's field
+			result.Reported = true
+			return errors.New(conflict.message())
+		case ConflictPolicyWarn:
+			conflict.Severity = framework.Warning
+			i.conflicts = append(i.conflicts, conflict)
+		}
+	}
 
-	cmdata := configMap.GetDataMap()
-	for key, val := range rendered {
-		cmdata[key] = val
+	for _, key := range keys {
+		owners[key] = result.Source
 		result.Keys = append(result.Keys, key)
 	}
-	configMap.SetDataMap(cmdata)
-	return configMap, nil
+
+	if result.Target.GetKind() == kindSecret {
+		if err := setSecretData(result.Source, result.Target, data); err != nil {
+			return err
+		}
+	} else if len(data) > 0 {
+		cmdata := result.Target.GetDataMap()
+		cmbinary := result.Target.GetBinaryDataMap()
+		moved := false
+		for key, val := range data {
+			cmdata[key] = val
+			if _, ok := cmbinary[key]; ok {
+				delete(cmbinary, key)
+				moved = true
+			}
+		}
+		result.Target.SetDataMap(cmdata)
+		if moved {
+			result.Target.SetBinaryDataMap(cmbinary)
+		}
+	}
+	if err := setBinaryData(result.Target, binaryData); err != nil {
+		return err
+	}
+
+	path, msg, err := checkTarget(result.Target)
+	if err != nil {
+		return err
+	}
+	if path != "" {
+		return &fieldError{Path: path, Err: errors.New(msg)}
+	}
+	return nil
+}
+
+// fail records err as the error of the result.
+func (r *injectResult) fail(err error) {
+	r.ErrorMsg = err.Error()
+	r.ErrorPath = errorPath(err)
+}
+
+// failAt records err as the error of the result, caused by the field at path
+// unless err holds a more specific path.
+func (r *injectResult) failAt(path string, err error) {
+	r.fail(err)
+	if r.ErrorPath == "" {
+		r.ErrorPath = path
+	}
 }
 
 func newInjectResult(source, target *yaml.RNode) *injectResult {
@@ -273,5 +1127,6 @@ func newInjectResult(source, target *yaml.RNode) *injectResult {
 		Source: source,
 		Target: target,
 		Keys:   []string{},
+		Merged: map[string]bool{},
 	}
 }
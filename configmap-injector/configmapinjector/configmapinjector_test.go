@@ -1,14 +1,19 @@
 package configmapinjector
 
 import (
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"sigs.k8s.io/kustomize/kyaml/fn/framework"
 	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
 type test struct {
@@ -16,7 +21,10 @@ type test struct {
 	input       string
 	expected    string
 	resultCount int
-	errorMsg    string
+	// resultMessages must each be contained in the message of a result
+	resultMessages []string
+	errorMsg       string
+	config         string
 }
 
 func TestConfigMapInjectorInject(t *testing.T) {
@@ -57,12 +65,14 @@ metadata:
     app.kubernetes.io/name: argocd-cm
     app.kubernetes.io/part-of: argocd
   name: argocd-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: repository.credentials
 data:
   repository.credentials: |
-    - passwordSecret:
+    - url: https://github.com/kumorilabs
+      passwordSecret:
         key: password
         name: git-reader
-      url: https://github.com/kumorilabs
       usernameSecret:
         key: username
         name: git-reader
@@ -109,6 +119,8 @@ metadata:
     app.kubernetes.io/name: argocd-cm
     app.kubernetes.io/part-of: argocd
   name: argocd-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: another-key,repository.credentials
 data:
   another-key: |
     enabled: false
@@ -116,10 +128,10 @@ data:
     num: 87
     val: "45"
   repository.credentials: |
-    - passwordSecret:
+    - url: https://github.com/kumorilabs
+      passwordSecret:
         key: password
         name: git-reader
-      url: https://github.com/kumorilabs
       usernameSecret:
         key: username
         name: git-reader
@@ -169,17 +181,21 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: cm1
+  annotations:
+    fn.kumorilabs.io/managed-keys: someyaml
 data:
   someyaml: |
+    with: values
     andLists:
     - one
     - two
-    with: values
 ---
 apiVersion: v1
 kind: ConfigMap
 metadata:
   name: cm2
+  annotations:
+    fn.kumorilabs.io/managed-keys: morestuff
 data:
   morestuff: |
     - map: val
@@ -221,12 +237,14 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: argocd-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: repository.credentials
 data:
   repository.credentials: |
-    - passwordSecret:
+    - url: https://github.com/kumorilabs
+      passwordSecret:
         key: password
         name: git-reader
-      url: https://github.com/kumorilabs
       usernameSecret:
         key: username
         name: git-reader
@@ -261,12 +279,14 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: argocd-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: repository.credentials
 data:
   repository.credentials: |
-    - passwordSecret:
+    - url: https://github.com/kumorilabs
+      passwordSecret:
         key: password
         name: git-reader
-      url: https://github.com/kumorilabs
       usernameSecret:
         key: username
         name: git-reader
@@ -319,6 +339,8 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.json
 data:
   config.json: |
     {
@@ -382,6 +404,8 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.json,data.json
 data:
   config.json: |
     {
@@ -504,6 +528,8 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.json
 data:
   config.json: |
     {
@@ -526,6 +552,8 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: another-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: data.json
 data:
   data.json: |
     {"file": "/tmp/data"}
@@ -575,6 +603,8 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.json
 data:
   config.json: |
     {
@@ -632,6 +662,8 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.json
 data:
   config.json: |
     {
@@ -682,6 +714,8 @@ apiVersion: v1
 kind: ConfigMap
 metadata:
   name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.json
 data:
   config.json: |
     {
@@ -695,82 +729,5308 @@ data:
 	runTests(t, tests)
 }
 
-func runTests(t *testing.T, tests []test) {
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			baseDir, err := ioutil.TempDir("", "")
-			if !assert.NoError(t, err, test.name) {
-				t.FailNow()
-			}
-			defer os.RemoveAll(baseDir)
-
-			r, err := ioutil.TempFile(baseDir, "k8s-cli-*.yaml")
-			if !assert.NoError(t, err, test.name) {
-				t.FailNow()
-			}
-			defer os.Remove(r.Name())
-			err = ioutil.WriteFile(r.Name(), []byte(test.input), 0600)
-			if !assert.NoError(t, err, test.name) {
-				t.FailNow()
-			}
-
-			configMaps := &framework.Selector{
-				Kinds:       []string{kindConfigMap},
-				APIVersions: []string{apiVersionConfigMap},
-			}
-
-			injector := &ConfigMapInjector{}
-			inout := &kio.LocalPackageReadWriter{
-				PackagePath: baseDir,
-			}
-			err = kio.Pipeline{
-				Inputs:  []kio.Reader{inout},
-				Filters: []kio.Filter{injector},
-				Outputs: []kio.Writer{inout},
-			}.Execute()
-
-			if test.errorMsg != "" {
-				if !assert.NotNil(t, err, test.name) {
-					t.FailNow()
-				}
-				if !assert.Contains(t, err.Error(), test.errorMsg) {
-					t.FailNow()
-				}
-			}
-
-			if test.errorMsg == "" && !assert.NoError(t, err, test.name) {
-				t.FailNow()
-			}
-
-			// get results
-			results, err := injector.Results()
-			if !assert.NoError(t, err, test.name, test.name) {
-				t.FailNow()
-			}
-			if !assert.Equal(t, test.resultCount, len(results), test.name) {
-				t.FailNow()
-			}
-
-			// filter to just configmaps so we can compare expected more easily
-			err = kio.Pipeline{
-				Inputs:  []kio.Reader{inout},
-				Filters: []kio.Filter{configMaps},
-				Outputs: []kio.Writer{inout},
-			}.Execute()
-			if !assert.NoError(t, err, test.name) {
-				t.FailNow()
-			}
-
-			actual, err := ioutil.ReadFile(r.Name())
-			if !assert.NoError(t, err, test.name) {
-				t.FailNow()
-			}
+func TestConfigMapInjectorTemplateFuncs(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "sprig and helm functions",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config.yaml: |
+    name: {{ .name | upper | quote }}
+    replicas: {{ get . "replicas" | default 1 }}
+    hosts: {{ .hosts | join "," }}
+    password: {{ .password | b64enc }}
+    server:{{ .server | toYaml | nindent 2 }}
+  server.json: '{{ .server | toJson }}'
+values:
+  name: app
+  hosts:
+  - a.example.com
+  - b.example.com
+  password: changeme
+  server:
+    port: 8080
+    tls:
+      enabled: true
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.yaml,server.json
+data:
+  config.yaml: |
+    name: "APP"
+    replicas: 1
+    hosts: a.example.com,b.example.com
+    password: Y2hhbmdlbWU=
+    server:
+      port: 8080
+      tls:
+        enabled: true
+  server.json: '{"port":8080,"tls":{"enabled":true}}'
+`,
+		},
+		{
+			name:        "required",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  url: '{{ required "url is required" .url }}'
+values:
+  url: ""
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "url is required",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "nondeterministic functions are disabled by default",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  id: '{{ uuidv4 }}'
+values: {}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: `function "uuidv4" not defined`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "nondeterministic functions enabled",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+nondeterministicFuncs: "true"
+data:
+  year: '{{ now | date "2006" | len }}'
+values: {}
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: year
+data:
+  year: "4"
+`,
+		},
+	}
+	runTests(t, tests)
+}
 
-			if !assert.Equal(t,
-				strings.TrimSpace(test.expected),
-				strings.TrimSpace(string(actual))) {
-				t.FailNow()
-			}
-		})
+func TestConfigMapInjectorForEach(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "valuesFrom sees the targets of earlier elements",
+			resultCount: 6,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: counter
+  annotations:
+    config.kubernetes.io/local-config: "true"
+forEach: names
+targets:
+- name: "{{.item}}-cm"
+- name: shared
+valuesFrom:
+- name: seen
+  resource:
+    kind: ConfigMap
+    name: shared
+  fieldPath: data
+data:
+  "{{.item}}": "{{len .seen}}"
+values:
+  names: [a, b, c]
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared
+data:
+  init: "0"
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: a-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: a
+data:
+  a: "1"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: b-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: b
+data:
+  b: "2"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: c-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: c
+data:
+  c: "3"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: shared
+  annotations:
+    fn.kumorilabs.io/managed-keys: a,b,c
+data:
+  a: "1"
+  b: "2"
+  c: "3"
+  init: "0"
+`,
+		},
+		{
+			name:        "one key per element",
+			resultCount: 2,
+			resultMessages: []string{
+				"ConfigMapTemplate tenants -> tenants with keys: [acme.yaml]",
+				"ConfigMapTemplate tenants -> tenants with keys: [globex.yaml]",
+			},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: tenants
+  annotations:
+    config.kubernetes.io/local-config: "true"
+forEach:
+  values: tenants
+  as: tenant
+data:
+  "{{.tenant.name}}.yaml": |
+    region: {{.region}}
+    quota: {{.tenant.quota}}
+values:
+  region: eu-west-1
+  tenants:
+  - name: acme
+    quota: 10
+  - name: globex
+    quota: 20
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: tenants
+  annotations:
+    fn.kumorilabs.io/managed-keys: acme.yaml,globex.yaml
+data:
+  acme.yaml: |
+    region: eu-west-1
+    quota: 10
+  globex.yaml: |
+    region: eu-west-1
+    quota: 20
+`,
+		},
+		{
+			name:        "one configmap per element",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: regions
+  annotations:
+    config.kubernetes.io/local-config: "true"
+forEach: regions
+target:
+  name: "app-{{.item}}"
+data:
+  region: "{{.item}}"
+values:
+  regions:
+  - us-east-1
+  - eu-west-1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-eu-west-1
+data:
+  other: value
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-us-east-1
+  annotations:
+    fn.kumorilabs.io/managed-keys: region
+data:
+  region: us-east-1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-eu-west-1
+  annotations:
+    fn.kumorilabs.io/managed-keys: region
+data:
+  other: value
+  region: eu-west-1
+`,
+		},
+		{
+			name:        "elements generate the same key",
+			resultCount: 2,
+			errorMsg:    `forEach: elements 0 and 1 both generate key "acme.yaml" in ConfigMap tenants`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: tenants
+  annotations:
+    config.kubernetes.io/local-config: "true"
+forEach:
+  values: tenants
+  as: tenant
+data:
+  "{{.tenant.name}}.yaml": |
+    quota: {{.tenant.quota}}
+values:
+  tenants:
+  - name: acme
+    quota: 10
+  - name: acme
+    quota: 20
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:        "keys render to the same name",
+			resultCount: 1,
+			errorMsg:    `forEach[0]: keys "{{ .item }}" and "{{.item}}" both render to "acme"`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: tenants
+  annotations:
+    config.kubernetes.io/local-config: "true"
+forEach: tenants
+data:
+  "{{.item}}": a
+  "{{ .item }}": b
+values:
+  tenants:
+  - acme
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:        "not a list",
+			resultCount: 1,
+			errorMsg:    "ConfigMapTemplate tenants: forEach: values.tenants must be a list, got string",
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: tenants
+  annotations:
+    config.kubernetes.io/local-config: "true"
+forEach: tenants
+data:
+  "{{.item}}": a
+values:
+  tenants: acme
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:        "label selector per element",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: tiers
+  annotations:
+    config.kubernetes.io/local-config: "true"
+forEach: tiers
+target:
+  labelSelector: "tier={{.item}}"
+format: raw
+data:
+  tier: "{{.item}}"
+values:
+  tiers:
+  - web
+  - db
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web-cm
+  labels:
+    tier: web
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: db-cm
+  labels:
+    tier: db
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: web-cm
+  labels:
+    tier: web
+  annotations:
+    fn.kumorilabs.io/managed-keys: tier
+data:
+  tier: web
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: db-cm
+  labels:
+    tier: db
+  annotations:
+    fn.kumorilabs.io/managed-keys: tier
+data:
+  tier: db
+`,
+		},
+		{
+			name:           "empty list",
+			resultCount:    1,
+			resultMessages: []string{"ConfigMapTemplate tenants: forEach list values.tenants is empty, nothing rendered"},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: tenants
+  annotations:
+    config.kubernetes.io/local-config: "true"
+forEach: tenants
+data:
+  "{{.item}}.yaml": "{{.item}}"
+values:
+  tenants: []
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorValuesFrom(t *testing.T) {
+	resources := `
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+  namespace: apps
+spec:
+  ports:
+  - name: http
+    port: 8080
+---
+apiVersion: networking.k8s.io/v1
+kind: Ingress
+metadata:
+  name: app
+  namespace: apps
+spec:
+  rules:
+  - host: app.example.com
+`
+	var tests = []test{
+		{
+			name:        "values from other resources",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  namespace: apps
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  url: https://{{.host}}:{{.port}}/{{.path}}
+  ports: '{{ .ports | toJson }}'
+values:
+  path: api
+  host: overridden
+valuesFrom:
+- name: port
+  resource:
+    kind: Service
+    name: app
+  fieldPath: spec.ports[name=http].port
+- name: ports
+  resource:
+    apiVersion: v1
+    kind: Service
+    name: app
+    namespace: apps
+  fieldPath: spec.ports
+- name: host
+  resource:
+    kind: Ingress
+    name: app
+  fieldPath: spec.rules[0].host
+` + resources,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  namespace: apps
+  annotations:
+    fn.kumorilabs.io/managed-keys: ports,url
+data:
+  ports: '[{"name":"http","port":8080}]'
+  url: https://app.example.com:8080/api
+`,
+		},
+		{
+			name:        "missing resource",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  namespace: apps
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  url: https://{{.host}}
+valuesFrom:
+- name: host
+  resource:
+    kind: Ingress
+    name: web
+  fieldPath: spec.rules[0].host
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  namespace: apps
+` + resources,
+			errorMsg: "valuesFrom[0]: Ingress apps/web not found",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  namespace: apps
+`,
+		},
+		{
+			name:        "missing field",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  namespace: apps
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  port: "{{.port}}"
+valuesFrom:
+- name: port
+  resource:
+    kind: Service
+    name: app
+  fieldPath: spec.ports[name=https].port
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  namespace: apps
+` + resources,
+			errorMsg: "valuesFrom[0]: fieldPath spec.ports[name=https].port not found in Service apps/app",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  namespace: apps
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorTemplateLibrary(t *testing.T) {
+	library := `
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplateLibrary
+metadata:
+  name: common
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  logging.tpl: |
+    {{- define "logging" -}}
+    logging:
+      level: {{ .logLevel }}
+    {{- end }}
+  tls.tpl: |
+    {{- define "tls" -}}
+    tls:
+      enabled: {{ .tls }}
+    {{- end }}
+`
+	var tests = []test{
+		{
+			name:        "template and include",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config.yaml: |
+    {{ template "logging" . }}
+    server:
+      {{- include "tls" . | nindent 2 }}
+values:
+  logLevel: debug
+  tls: true
+` + library,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.yaml
+data:
+  config.yaml: |
+    logging:
+      level: debug
+    server:
+      tls:
+        enabled: true
+`,
+		},
+		{
+			name:        "undefined template",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config.yaml: |
+    {{ include "metrics" . }}
+values: {}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+` + library,
+			errorMsg: `template "metrics" referenced by config.yaml is not defined`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "cyclic include",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config.yaml: |
+    {{ include "a" . }}
+values: {}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplateLibrary
+metadata:
+  name: cyclic
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  a.tpl: '{{ define "a" }}{{ include "b" . }}{{ end }}'
+  b.tpl: '{{ define "b" }}{{ template "a" . }}{{ end }}'
+`,
+			errorMsg: "cyclic template reference: config.yaml -> a -> b -> a",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "template defined twice",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config.yaml: |
+    {{ include "logging" . }}
+values: {}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplateLibrary
+metadata:
+  name: other
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  logging.tpl: '{{ define "logging" }}{{ end }}'
+` + library,
+			errorMsg: `template "logging" is defined in both ConfigMapTemplateLibrary other`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorTemplateValues(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "layered values",
+			resultCount: 1,
+			resultMessages: []string{
+				"ConfigMapTemplate app-cm -> app-cm with keys: [config.yaml], values: " +
+					"baseUrl from TemplateValues prod, " +
+					"logLevel from function config, " +
+					"name from values, " +
+					"server.port from TemplateValues common, " +
+					"server.timeout from ConfigMapTemplateLibrary defaults, " +
+					"server.tls from values",
+			},
+			config: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInjector
+metadata:
+  name: configmap-injector
+values:
+  logLevel: warn
+`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+templateValues:
+- common
+- prod
+data:
+  config.yaml: |
+    name: {{ .name }}
+    url: {{ .baseUrl }}
+    logLevel: {{ .logLevel }}
+    server:{{ .server | toYaml | nindent 2 }}
+values:
+  name: app
+  logLevel: debug
+  server:
+    tls: true
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplateLibrary
+metadata:
+  name: defaults
+  annotations:
+    config.kubernetes.io/local-config: "true"
+values:
+  logLevel: info
+  server:
+    port: 80
+    timeout: 30s
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: TemplateValues
+metadata:
+  name: common
+  annotations:
+    config.kubernetes.io/local-config: "true"
+values:
+  baseUrl: https://dev.example.com
+  server:
+    port: 8080
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: TemplateValues
+metadata:
+  name: prod
+  annotations:
+    config.kubernetes.io/local-config: "true"
+values:
+  baseUrl: https://example.com
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.yaml
+data:
+  config.yaml: |
+    name: app
+    url: https://example.com
+    logLevel: warn
+    server:
+      port: 8080
+      timeout: 30s
+      tls: true
+`,
+		},
+		{
+			name:        "missing TemplateValues",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+templateValues:
+- common
+data:
+  url: "{{ .baseUrl }}"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "templateValues[0]: TemplateValues common not found",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorValuesSchema(t *testing.T) {
+	var tests = []test{
+		{
+			name:           "defaults",
+			resultCount:    1,
+			resultMessages: []string{"logLevel from valuesSchema defaults"},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config: "{{ .name }}:{{ .port }} {{ .logLevel }}"
+values:
+  name: app
+  port: 8080
+valuesSchema:
+  type: object
+  required:
+  - name
+  - port
+  properties:
+    name:
+      type: string
+      pattern: ^[a-z-]+$
+    port:
+      type: integer
+    logLevel:
+      type: string
+      enum: [debug, info, warn]
+      default: info
+    hosts:
+      type: array
+      items:
+        type: string
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config
+data:
+  config: app:8080 info
+`,
+		},
+		{
+			name:        "field errors",
+			resultCount: 4,
+			resultMessages: []string{
+				"values.hosts[1] must be of type string, got number",
+				"values.logLevel must be one of [debug info warn]",
+				`values.name must match pattern "^[a-z-]+$"`,
+				"values.port is required",
+			},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config: "{{ .name }}:{{ .port }} {{ .logLevel }}"
+values:
+  name: App
+  port: ""
+  logLevel: trace
+  hosts:
+  - a.example.com
+  - 1
+valuesSchema:
+  type: object
+  required:
+  - name
+  - port
+  properties:
+    name:
+      type: string
+      pattern: ^[a-z-]+$
+    port:
+      type: integer
+    logLevel:
+      type: string
+      enum: [debug, info, warn]
+      default: info
+    hosts:
+      type: array
+      items:
+        type: string
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "values don't match valuesSchema",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:           "wrong type",
+			resultCount:    1,
+			resultMessages: []string{"values.port must be of type integer, got string"},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config: "{{ .name }}:{{ .port }}"
+values:
+  name: app
+  port: "8080"
+valuesSchema:
+  type: object
+  required:
+  - name
+  - port
+  properties:
+    name:
+      type: string
+      pattern: ^[a-z-]+$
+    port:
+      type: integer
+    logLevel:
+      type: string
+      enum: [debug, info, warn]
+      default: info
+    hosts:
+      type: array
+      items:
+        type: string
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "values.port must be of type integer, got string",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "invalid schema",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config: "{{ .port }}"
+values:
+  port: 8080
+valuesSchema:
+  properties:
+    port:
+      type: int
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: `valuesSchema.properties.port.type: unsupported type "int"`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorProfiles(t *testing.T) {
+	var tests = []test{
+		{
+			name:           "disabled source",
+			resultCount:    2,
+			resultMessages: []string{"ConfigMapInject debug is disabled, skipped"},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: debug
+  annotations:
+    config.kubernetes.io/local-config: "true"
+enabled: "false" # kpt-set: ${debug-enabled}
+target:
+  name: some-cm
+data:
+  debug: "true"
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: logging
+  annotations:
+    config.kubernetes.io/local-config: "true"
+enabled: true
+target:
+  name: some-cm
+data:
+  level: info
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    info
+`,
+		},
+		{
+			name:           "disabled source prunes its keys",
+			resultCount:    2,
+			resultMessages: []string{"pruned keys no longer provided by any source from ConfigMap some-cm: [debug]"},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+enabled: false
+data:
+  debug: "true"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: debug
+data:
+  debug: |
+    true
+  other: value
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+data:
+  other: value
+`,
+		},
+		{
+			name:        "invalid enabled",
+			resultCount: 1,
+			errorMsg:    `ConfigMapInject debug: enabled must be a boolean, got "maybe"`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: debug
+  annotations:
+    config.kubernetes.io/local-config: "true"
+enabled: maybe
+data:
+  debug: "true"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:           "active profile",
+			resultCount:    2,
+			resultMessages: []string{"replicas from profiles.prod, tier from values", "ConfigMapInject debug is disabled, skipped"},
+			config: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fn-config
+data:
+  profile: prod
+`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  app.yaml: |
+    tier: {{.tier}}
+    replicas: {{.replicas}}
+values:
+  tier: backend
+  replicas: 1
+profiles:
+  prod:
+    data:
+      level: warn
+    values:
+      replicas: 3
+  dev:
+    values:
+      replicas: 0
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: debug
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  name: app-cm
+data:
+  debug: "true"
+profiles:
+  prod:
+    enabled: false
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: app.yaml,level
+data:
+  app.yaml: |
+    tier: backend
+    replicas: 3
+  level: warn
+`,
+		},
+		{
+			name:        "unsupported profile field",
+			resultCount: 1,
+			errorMsg:    "ConfigMapInject debug: profiles.prod.order: unsupported field, must be one of [enabled data values]",
+			config: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInjector
+metadata:
+  name: configmap-injector
+profile: prod
+`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: debug
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  debug: "true"
+profiles:
+  prod:
+    order: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorFormat(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "source and key formats",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+format: json
+keys:
+  config.pretty.json:
+    format: json-pretty
+  app.properties:
+    format: properties
+  app.env:
+    format: env
+  app.ini:
+    format: ini
+  app.toml:
+    format: toml
+  app.yaml:
+    format: yaml
+  version:
+    format: raw
+data:
+  config.json:
+    server:
+      port: 8080
+    features: [a, b]
+  config.pretty.json:
+    server:
+      port: 8080
+  app.properties:
+    server:
+      port: 8080
+      name: my app
+    spring.profiles: [dev, local]
+  app.env:
+    db:
+      url: postgres://db:5432/app
+    log-level: debug
+    greeting: hello world
+  app.ini:
+    name: app
+    server:
+      port: 8080
+      host: localhost
+  app.toml:
+    title: app
+    server:
+      port: 8080
+  app.yaml:
+    port: 8080
+  version: 1.10
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: app.env,app.ini,app.properties,app.toml,app.yaml,config.json,config.pretty.json,version
+data:
+  app.env: |
+    db_url=postgres://db:5432/app
+    greeting="hello world"
+    log_level=debug
+  app.ini: |
+    name = app
+
+    [server]
+    host = localhost
+    port = 8080
+  app.properties: |
+    server.name=my app
+    server.port=8080
+    spring.profiles[0]=dev
+    spring.profiles[1]=local
+  app.toml: |
+    title = "app"
+
+    [server]
+    port = 8080
+  app.yaml: |
+    port: 8080
+  config.json: '{"server":{"port":8080},"features":["a","b"]}'
+  config.pretty.json: |
+    {
+      "server": {
+        "port": 8080
+      }
+    }
+  version: "1.10"
+`,
+		},
+		{
+			name:        "keeps comments",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+comments: keep
+keys:
+  stripped.yaml:
+    comments: strip
+data:
+  config.yaml:
+    # the server configuration
+    server:
+      url: https://example.com # kpt-set: ${url}
+      port: 8080
+  stripped.yaml:
+    url: https://example.com # kpt-set: ${url}
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.yaml,stripped.yaml
+data:
+  config.yaml: |
+    # the server configuration
+    server:
+      url: https://example.com # kpt-set: ${url}
+      port: 8080
+  stripped.yaml: |
+    url: https://example.com
+`,
+		},
+		{
+			name:        "raw requires a scalar",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+format: raw
+data:
+  config:
+    port: 8080
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: `data.config: format "raw" only supports scalar values`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "unsupported format",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+format: xml
+data:
+  config:
+    port: 8080
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: `format: unsupported format "xml"`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorOrder(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "template runs after inject",
+			resultCount: 3,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: "{{.level}}"
+values:
+  level: template
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: inject
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: template
+`,
+		},
+		{
+			name:        "later sources in the file win",
+			resultCount: 3,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: first
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: second
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    second
+`,
+		},
+		{
+			name:        "highest order wins",
+			resultCount: 5,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+order: 10
+data:
+  level: inject
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: "{{.level}}"
+values:
+  level: template
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+order: "5" # kpt-set: ${order}
+data:
+  level: setter
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    inject
+`,
+		},
+		{
+			name:        "invalid order",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+order: first
+data:
+  level: inject
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+			errorMsg: `order: must be an integer, got "first"`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+		},
+		{
+			name:        "invalid order doesn't stop the other sources",
+			resultCount: 2,
+			resultMessages: []string{
+				`order: must be an integer, got "first"`,
+				"ConfigMapInject other-cm -> other-cm with keys: [level]",
+			},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+order: first
+data:
+  level: inject
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: other-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: inject
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			errorMsg: `order: must be an integer, got "first"`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorTargetMetadata(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "generated configmap inherits source metadata",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  namespace: apps
+  labels:
+    app: some-app
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/function: |
+      container:
+        image: ghcr.io/kumorilabs/krm-fn-configmap-injector:0.3
+    fn.kumorilabs.io/some-option: "true"
+    team: platform
+data:
+  level: debug
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+  labels:
+    app: some-app
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+    team: platform
+data:
+  level: |
+    debug
+`,
+		},
+		{
+			name:        "generated configmap uses target metadata",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  labels:
+    app: injector
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    team: platform
+targetMetadata:
+  namespace: apps
+  labels:
+    app: some-app
+  annotations:
+    reloader.stakater.com/match: "true"
+data:
+  level: debug
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+  labels:
+    app: some-app
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+    reloader.stakater.com/match: "true"
+data:
+  level: |
+    debug
+`,
+		},
+		{
+			name:        "target metadata merges into existing",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+targetMetadata:
+  namespace: apps
+  labels:
+    tier: backend
+data:
+  level: "{{.level}}"
+values:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+  labels:
+    app: some-app
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+  labels:
+    app: some-app
+    tier: backend
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: debug
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorTarget(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "target overrides source name and namespace",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-config
+  namespace: default
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  name: some-cm
+  namespace: apps
+data:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+`,
+		},
+		{
+			name:        "fan out to multiple namespaces",
+			resultCount: 3,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: ca-bundle
+  annotations:
+    config.kubernetes.io/local-config: "true"
+targets:
+- namespace: frontend
+  name: ca-bundle
+- namespace: backend
+  name: ca-bundle
+- namespace: jobs
+  name: ca-bundle
+data:
+  ca.crt: some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ca-bundle
+  namespace: backend
+data:
+  other: value
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ca-bundle
+  namespace: frontend
+  annotations:
+    fn.kumorilabs.io/managed-keys: ca.crt
+data:
+  ca.crt: |
+    some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ca-bundle
+  namespace: jobs
+  annotations:
+    fn.kumorilabs.io/managed-keys: ca.crt
+data:
+  ca.crt: |
+    some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ca-bundle
+  namespace: backend
+  annotations:
+    fn.kumorilabs.io/managed-keys: ca.crt
+data:
+  ca.crt: |
+    some-cert
+  other: value
+`,
+		},
+		{
+			name:        "distinct sources target the same configmap",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: logging
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  name: some-cm
+data:
+  level: debug
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: database
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  name: some-cm
+data:
+  db: "{{.host}}:5432"
+values:
+  host: postgres
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: db,level
+data:
+  db: postgres:5432
+  level: |
+    debug
+`,
+		},
+		{
+			name:        "label selector",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: ca-bundle
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  labelSelector: ca-bundle=true
+data:
+  ca.crt: some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: frontend-cm
+  namespace: frontend
+  labels:
+    ca-bundle: "true"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: backend-cm
+  namespace: backend
+  labels:
+    ca-bundle: "true"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+  namespace: backend
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: frontend-cm
+  namespace: frontend
+  labels:
+    ca-bundle: "true"
+  annotations:
+    fn.kumorilabs.io/managed-keys: ca.crt
+data:
+  ca.crt: |
+    some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: backend-cm
+  namespace: backend
+  labels:
+    ca-bundle: "true"
+  annotations:
+    fn.kumorilabs.io/managed-keys: ca.crt
+data:
+  ca.crt: |
+    some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+  namespace: backend
+`,
+		},
+		{
+			name:        "label selector without match",
+			resultCount: 1,
+			errorMsg:    `ConfigMapInject ca-bundle: no ConfigMap matches labelSelector "ca-bundle=true"`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: ca-bundle
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  labelSelector: ca-bundle=true
+data:
+  ca.crt: some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:        "target and targets",
+			resultCount: 1,
+			errorMsg:    "ConfigMapInject ca-bundle: target and targets are mutually exclusive",
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: ca-bundle
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  name: some-cm
+targets:
+- name: other-cm
+data:
+  ca.crt: some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:        "target without name or label selector",
+			resultCount: 1,
+			errorMsg:    "ConfigMapInject ca-bundle: targets[1]: exactly one of name or labelSelector is required",
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: ca-bundle
+  annotations:
+    config.kubernetes.io/local-config: "true"
+targets:
+- name: some-cm
+- namespace: apps
+data:
+  ca.crt: some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:        "path with label selector",
+			resultCount: 1,
+			errorMsg:    "ConfigMapInject ca-bundle: targets[0]: path only applies to targets selected by name",
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: ca-bundle
+  annotations:
+    config.kubernetes.io/local-config: "true"
+targets:
+- labelSelector: ca-bundle=true
+  path: ca-bundle.yaml
+data:
+  ca.crt: some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:        "output path outside of the package",
+			resultCount: 1,
+			errorMsg:    `ConfigMapInject ca-bundle: output path "../ca-bundle.yaml" must be relative to the package`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: ca-bundle
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    fn.kumorilabs.io/output-path: ../ca-bundle.yaml
+data:
+  ca.crt: some-cert
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorNamespaceMatching(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "exact generates a duplicate",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+`,
+		},
+		{
+			name:        "source defaults to target",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+namespaceMatching: sourceDefaultsToTarget
+data:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+`,
+		},
+		{
+			name:        "source with namespace doesn't default to target",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  namespace: other
+  annotations:
+    config.kubernetes.io/local-config: "true"
+namespaceMatching: sourceDefaultsToTarget
+data:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: other
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+`,
+		},
+		{
+			name:        "ignore from function config",
+			resultCount: 1,
+			config: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fn-config
+data:
+  namespaceMatching: ignore
+`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  namespace: apps
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+`,
+		},
+		{
+			name:           "ignore matches more than one target",
+			resultCount:    1,
+			errorMsg:       `ConfigMapInject some-cm: ConfigMap some-cm matches 2 targets in namespaces ["apps" "jobs"] (namespaceMatching: ignore)`,
+			resultMessages: []string{"matches 2 targets"},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+namespaceMatching: ignore
+data:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: jobs
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: apps
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  namespace: jobs
+`,
+		},
+		{
+			name:        "invalid mode",
+			resultCount: 1,
+			errorMsg:    `ConfigMapInject some-cm: namespaceMatching must be one of "exact", "sourceDefaultsToTarget" or "ignore", got "loose"`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+namespaceMatching: loose
+data:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorSecret(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "inject into existing secret data",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretInject
+metadata:
+  name: argocd-secret
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  credentials:
+    username: admin
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: argocd-secret
+type: kubernetes.io/basic-auth
+data:
+  password: c2VjcmV0
+`,
+			expected: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: argocd-secret
+  annotations:
+    fn.kumorilabs.io/managed-keys: credentials
+type: kubernetes.io/basic-auth
+data:
+  credentials: dXNlcm5hbWU6IGFkbWluCg==
+  password: c2VjcmV0
+`,
+		},
+		{
+			name:        "template into stringData",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretTemplate
+metadata:
+  name: app-secret
+  annotations:
+    config.kubernetes.io/local-config: "true"
+dataField: stringData
+data:
+  password: "{{.password}}"
+  url: postgres://app:{{.password}}@db:5432/app
+values:
+  password: hunter2
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+data:
+  password: c2VjcmV0
+`,
+			expected: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+  annotations:
+    fn.kumorilabs.io/managed-keys: url
+stringData:
+  password: hunter2
+  url: postgres://app:hunter2@db:5432/app
+`,
+		},
+		{
+			name:        "generates secret if it doesn't exist",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretTemplate
+metadata:
+  name: tls-secret
+  annotations:
+    config.kubernetes.io/local-config: "true"
+type: kubernetes.io/tls
+data:
+  tls.crt: "{{.crt}}"
+  tls.key: "{{.key}}"
+values:
+  crt: cert
+  key: key
+`,
+			expected: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: tls-secret
+  annotations:
+    fn.kumorilabs.io/managed-keys: tls.crt,tls.key
+type: kubernetes.io/tls
+data:
+  tls.crt: Y2VydA==
+  tls.key: a2V5
+`,
+		},
+		{
+			name:        "secret and configmap with the same name",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretInject
+metadata:
+  name: app
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: debug
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: debug
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+type: Opaque
+data:
+  level: ZGVidWc=
+`,
+		},
+		{
+			name:        "invalid data field",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretInject
+metadata:
+  name: app
+  annotations:
+    config.kubernetes.io/local-config: "true"
+dataField: binaryData
+data:
+  level: debug
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+`,
+			errorMsg: `dataField must be "data" or "stringData"`,
+			expected: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorHashSuffix(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "hash suffix with reference updates",
+			resultCount: 4,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+hashSuffix: true
+data:
+  level: debug
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretTemplate
+metadata:
+  name: app-secret
+  annotations:
+    config.kubernetes.io/local-config: "true"
+hashSuffix: "true" # kpt-set: ${hash-suffix}
+data:
+  password: "{{.password}}"
+values:
+  password: hunter2
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+type: Opaque
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        envFrom:
+        - configMapRef:
+            name: app-cm
+        env:
+        - name: PASSWORD
+          valueFrom:
+            secretKeyRef:
+              name: app-secret
+              key: password
+      volumes:
+      - name: config
+        configMap:
+          name: app-cm
+      - name: all
+        projected:
+          sources:
+          - configMap:
+              name: app-cm
+          - secret:
+              name: app-secret
+          - configMap:
+              name: other-cm
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: job
+  namespace: other
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          volumes:
+          - name: config
+            configMap:
+              name: app-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm-g98k2tk7m2
+  annotations:
+    fn.kumorilabs.io/base-name: app-cm
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret-cf85kd65mm
+  annotations:
+    fn.kumorilabs.io/base-name: app-secret
+    fn.kumorilabs.io/managed-keys: password
+type: Opaque
+data:
+  password: aHVudGVyMg==
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        envFrom:
+        - configMapRef:
+            name: app-cm-g98k2tk7m2
+        env:
+        - name: PASSWORD
+          valueFrom:
+            secretKeyRef:
+              name: app-secret-cf85kd65mm
+              key: password
+      volumes:
+      - name: config
+        configMap:
+          name: app-cm-g98k2tk7m2
+      - name: all
+        projected:
+          sources:
+          - configMap:
+              name: app-cm-g98k2tk7m2
+          - secret:
+              name: app-secret-cf85kd65mm
+          - configMap:
+              name: other-cm
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: job
+  namespace: other
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          volumes:
+          - name: config
+            configMap:
+              name: app-cm
+`,
+		},
+		{
+			name:        "rehashes previously hashed target",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+hashSuffix: true
+data:
+  level: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm-g98k2tk7m2
+  annotations:
+    fn.kumorilabs.io/base-name: app-cm
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  containers:
+  - name: app
+    env:
+    - name: LEVEL
+      valueFrom:
+        configMapKeyRef:
+          name: app-cm-g98k2tk7m2
+          key: level
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm-4ftkhfb492
+  annotations:
+    fn.kumorilabs.io/base-name: app-cm
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    info
+---
+apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  containers:
+  - name: app
+    env:
+    - name: LEVEL
+      valueFrom:
+        configMapKeyRef:
+          name: app-cm-4ftkhfb492
+          key: level
+`,
+		},
+		{
+			name:        "invalid hash suffix",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+hashSuffix: sometimes
+data:
+  level: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "hashSuffix must be a boolean",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorHashSuffixRenderTwice(t *testing.T) {
+	dir := writePackage(t, `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app
+  annotations:
+    config.kubernetes.io/local-config: "true"
+hashSuffix: true
+data:
+  level: debug
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        envFrom:
+        - configMapRef:
+            name: app
+`)
+	defer os.RemoveAll(dir)
+
+	first := renderPackage(t, dir)
+	assert.Contains(t, first, "name: app-")
+
+	// render again, keeping the results
+	injector := &ConfigMapInjector{}
+	inout := &kio.LocalPackageReadWriter{PackagePath: dir}
+	err := kio.Pipeline{
+		Inputs:  []kio.Reader{inout},
+		Filters: []kio.Filter{injector},
+		Outputs: []kio.Writer{inout},
+	}.Execute()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, first, readPackage(t, dir))
+	results, err := injector.Results()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	for _, result := range results {
+		assert.NotContains(t, result.Message, "renamed")
+	}
+}
+
+func TestConfigMapInjectorPrune(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "prunes keys no source provides",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+format: raw
+data:
+  level: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level,removed
+data:
+  custom: hand-written
+  level: debug
+  removed: stale
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  custom: hand-written
+  level: info
+`,
+		},
+		{
+			name:        "prunes all keys when sources are removed",
+			resultCount: 1,
+			input: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+  annotations:
+    fn.kumorilabs.io/managed-keys: password
+type: Opaque
+data:
+  password: c2VjcmV0
+stringData:
+  username: admin
+`,
+			expected: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+type: Opaque
+stringData:
+  username: admin
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorPruneKeepsUpstreamKeys(t *testing.T) {
+	dir := writePackage(t, `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: argocd-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+enabled: true
+keys:
+  resource.customizations:
+    mergeStrategy: deepMerge
+data:
+  resource.customizations:
+    apps/Deployment:
+      health.lua: custom
+  url: https://argocd.example.com
+  application.instanceLabelKey: argocd.argoproj.io/instance
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: argocd-cm
+data:
+  resource.customizations: |
+    networking.k8s.io/Ingress:
+      health.lua: upstream
+  application.instanceLabelKey: app.kubernetes.io/instance
+`)
+	defer os.RemoveAll(dir)
+
+	first := renderPackage(t, dir)
+	assert.Contains(t, first, "fn.kumorilabs.io/managed-keys: url\n")
+
+	// disable the source and render the output again
+	path := filepath.Join(dir, "package.yaml")
+	content, err := ioutil.ReadFile(path)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	content = []byte(strings.Replace(string(content), "enabled: true", "enabled: false", 1))
+	if err := ioutil.WriteFile(path, content, 0600); !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	second := renderPackage(t, dir)
+
+	target := second[strings.Index(second, "kind: ConfigMap\n"):]
+	assert.NotContains(t, target, "url:")
+	assert.NotContains(t, target, "managed-keys")
+	assert.Contains(t, target, "health.lua: upstream")
+	assert.Contains(t, target, "argocd.argoproj.io/instance")
+}
+
+func TestConfigMapInjectorCreateRenderTwice(t *testing.T) {
+	first, second := renderTwice(t, `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+behavior: create
+data:
+  level: debug
+`)
+	assert.Contains(t, first, "name: app-cm")
+	assert.Equal(t, first, second)
+}
+
+func TestConfigMapInjectorBinaryData(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "binary data",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+binaryData:
+  blob.bin: YmluYXJ5AGNvbnRlbnQ=
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+data:
+  blob.bin: old
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+binaryData:
+  blob.bin: YmluYXJ5AGNvbnRlbnQ=
+`,
+		},
+		{
+			name:        "gzip",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  dashboard.json.gz:
+    format: raw
+    gzip: true
+data:
+  level: debug
+  dashboard.json.gz: |
+    {"title": "dashboard"}
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: dashboard.json.gz,level
+data:
+  level: |
+    debug
+binaryData:
+  dashboard.json.gz: H4sIAAAAAAAA/wAXAOj/eyJ0aXRsZSI6ICJkYXNoYm9hcmQifQoDAJG8xJsXAAAA
+`,
+		},
+		{
+			name:        "binary data in secret",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretInject
+metadata:
+  name: some-secret
+  annotations:
+    config.kubernetes.io/local-config: "true"
+binaryData:
+  blob.bin: YmluYXJ5AGNvbnRlbnQ=
+`,
+			expected: `
+apiVersion: v1
+kind: Secret
+metadata:
+  name: some-secret
+  annotations:
+    fn.kumorilabs.io/managed-keys: blob.bin
+type: Opaque
+data:
+  blob.bin: YmluYXJ5AGNvbnRlbnQ=
+`,
+		},
+		{
+			name:           "invalid key name",
+			resultCount:    1,
+			errorMsg:       `data.app config: invalid key name "app config", must match ^[-._a-zA-Z0-9]+$`,
+			resultMessages: []string{`invalid key name "app config"`},
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  app config: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+		},
+		{
+			name:        "key in data and binary data",
+			resultCount: 1,
+			errorMsg:    `binaryData.blob.bin: key "blob.bin" is set in both data and binaryData`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  blob.bin: text
+binaryData:
+  blob.bin: YmluYXJ5AGNvbnRlbnQ=
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+		},
+		{
+			name:        "invalid base64",
+			resultCount: 1,
+			errorMsg:    "binaryData.blob.bin: invalid base64: illegal base64 data at input byte 3",
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+binaryData:
+  blob.bin: not base64
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+`,
+		},
+		{
+			name:        "over size limit",
+			resultCount: 1,
+			errorMsg:    "data: ConfigMap some-cm is 1048585 bytes, over the limit of 1048576 bytes",
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  big.txt:
+    format: raw
+data:
+  big.txt: ` + strings.Repeat("a", 1024*1024) + `
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+data:
+  a: b
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+data:
+  a: b
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorBehavior(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "create generates target",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+behavior: create
+format: raw
+data:
+  level: info
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+behavior: create
+format: raw
+data:
+  port: "8080"
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level,port
+data:
+  level: info
+  port: "8080"
+`,
+		},
+		{
+			name:        "create fails if target exists",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+behavior: create
+data:
+  level: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "ConfigMapInject app-cm: ConfigMap app-cm already exists (behavior: create)",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "replace discards existing data",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+format: raw
+data:
+  level: info
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+behavior: replace
+data:
+  url: "{{.url}}"
+values:
+  url: https://example.com
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  upstream: value
+binaryData:
+  blob: aGVsbG8=
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level,url
+data:
+  level: info
+  url: https://example.com
+`,
+		},
+		{
+			name:        "mustExist fails if target is missing",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: argocd-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+behavior: mustExist
+data:
+  level: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: argcd-cm
+`,
+			errorMsg: "ConfigMapInject argocd-cm: ConfigMap argocd-cm not found (behavior: mustExist)",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: argcd-cm
+`,
+		},
+		{
+			name:        "invalid behavior",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+behavior: upsert
+data:
+  level: info
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "behavior must be one of",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorMergeStrategy(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "deepMerge into embedded yaml",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.yaml:
+    mergeStrategy: deepMerge
+data:
+  config.yaml:
+    server:
+      port: 9090
+      tls: null
+    features:
+    - metrics
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: |
+    # upstream config
+    server:
+      host: 0.0.0.0
+      port: 8080
+      tls: true
+    features:
+    - tracing
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: |
+    # upstream config
+    server:
+      host: 0.0.0.0
+      port: 9090
+    features:
+    - metrics
+`,
+		},
+		{
+			name:        "deepMerge keeps json format",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  compact.json:
+    mergeStrategy: deepMerge
+  pretty.json:
+    mergeStrategy: deepMerge
+data:
+  compact.json:
+    b: 2
+  pretty.json:
+    b: 2
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  compact.json: '{"a":1,"b":1}'
+  pretty.json: |
+    {
+      "a": 1
+    }
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  compact.json: '{"a":1,"b":2}'
+  pretty.json: |
+    {
+      "a": 1,
+      "b": 2
+    }
+`,
+		},
+		{
+			name:        "deepMerge keeps comments, indentation and numbers",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.yaml:
+    mergeStrategy: deepMerge
+  config.json:
+    mergeStrategy: deepMerge
+data:
+  config.yaml:
+    log:
+      level: debug
+  config.json:
+    b: 2
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: |
+    log:
+        level: info # default
+        format: json
+  config.json: |
+    {
+        "a": 1.50
+    }
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.json: |
+    {
+        "a": 1.50,
+        "b": 2
+    }
+  config.yaml: |
+    log:
+        level: debug # default
+        format: json
+`,
+		},
+		{
+			name:        "strategicList merges list elements by key",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: argocd-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  repositories:
+    mergeStrategy: strategicList
+    mergeKey: url
+data:
+  repositories:
+  - url: https://github.com/example/a
+    type: helm
+  - url: https://github.com/example/c
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: argocd-cm
+data:
+  repositories: |
+    - url: https://github.com/example/a
+      name: a
+    - url: https://github.com/example/b
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: argocd-cm
+data:
+  repositories: |
+    - url: https://github.com/example/a
+      name: a
+      type: helm
+    - url: https://github.com/example/b
+    - url: https://github.com/example/c
+`,
+		},
+		{
+			name:        "deepMerge sets key missing from target",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.yaml:
+    mergeStrategy: deepMerge
+data:
+  config.yaml:
+    port: 9090
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.yaml
+data:
+  config.yaml: |
+    port: 9090
+`,
+		},
+		{
+			name:        "deepMerge by multiple sources is not a conflict",
+			resultCount: 2,
+			config: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInjector
+metadata:
+  name: configmap-injector
+conflictPolicy: error
+`,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  config.yaml:
+    a: 1
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+order: 1
+keys:
+  config.yaml:
+    mergeStrategy: deepMerge
+data:
+  config.yaml:
+    b: 2
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: config.yaml
+data:
+  config.yaml: |
+    a: 1
+    b: 2
+`,
+		},
+		{
+			name:        "existing value is not yaml",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.yaml:
+    mergeStrategy: deepMerge
+data:
+  config.yaml:
+    a: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: "a: [1"
+`,
+			errorMsg: "data.config.yaml: unable to parse existing value",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: "a: [1"
+`,
+		},
+		{
+			name:        "invalid merge strategy",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.yaml:
+    mergeStrategy: overlay
+data:
+  config.yaml:
+    a: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "keys.config.yaml.mergeStrategy: unsupported merge strategy",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorPatch(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "jsonPatch add to the end of a list",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: jsonPatch
+  key: config.yaml
+  patch:
+  - op: add
+    path: /appended/-
+    value: one
+  - op: add
+    path: /skipped/-
+    value: one
+    skipIfPresent: true
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: |
+    appended:
+    - one
+    skipped:
+    - one
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: |
+    appended:
+    - one
+    - one
+    skipped:
+    - one
+`,
+		},
+		{
+			name:        "json patch and merge patch",
+			resultCount: 3,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: jsonPatch
+  key: config.yaml
+  patch:
+  - op: replace
+    path: /server/port
+    value: 9090
+  - op: add
+    path: /features/-
+    value: metrics
+  - op: remove
+    path: /server/tls
+- op: mergePatch
+  key: config.json
+  patch:
+    log:
+      level: debug
+      format: null
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.json: '{"log":{"level":"info","format":"json"},"name":"app"}'
+  config.yaml: |
+    # upstream config
+    server:
+      port: 8080 # the port
+      tls: true
+    features:
+    - tracing
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.json: '{"log":{"level":"debug"},"name":"app"}'
+  config.yaml: |
+    # upstream config
+    server:
+      port: 9090
+    features:
+    - tracing
+    - metrics
+`,
+		},
+		{
+			name:        "plain-text operations",
+			resultCount: 5,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: regexReplace
+  key: nginx.conf
+  pattern: 'listen \d+;'
+  replacement: listen 8080;
+- op: rename
+  key: old.conf
+  to: new.conf
+- op: delete
+  key: obsolete
+- op: delete
+  key: missing
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  nginx.conf: |
+    server {
+      listen 80;
+    }
+  obsolete: "true"
+  old.conf: value
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  new.conf: value
+  nginx.conf: |
+    server {
+      listen 8080;
+    }
+`,
+		},
+		{
+			name:        "failed json patch test",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: jsonPatch
+  key: config.yaml
+  patch:
+  - op: test
+    path: /server/port
+    value: 80
+  - op: replace
+    path: /server/port
+    value: 9090
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: |
+    server:
+      port: 8080
+`,
+			errorMsg: `operations[0]: jsonPatch of key "config.yaml": patch[0]: test /server/port: test failed`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  config.yaml: |
+    server:
+      port: 8080
+`,
+		},
+		{
+			name:        "missing key",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: mergePatch
+  key: config.yaml
+  patch:
+    a: 1
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: `operations[0]: mergePatch of key "config.yaml": key not found`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "missing target",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: delete
+  key: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+			errorMsg: "ConfigMapPatch app-cm: ConfigMap app-cm not found (behavior: mustExist)",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: other-cm
+`,
+		},
+		{
+			name:        "unsupported op",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: append
+  key: a
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: `operations[0]: unsupported op "append"`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorPatchRenderTwice(t *testing.T) {
+	first, second := renderTwice(t, `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  injected.conf:
+    format: raw
+data:
+  injected.conf: level=debug
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: rename
+  key: old.conf
+  to: new.conf
+- op: rename
+  key: injected.conf
+  to: renamed.conf
+- op: jsonPatch
+  key: config.yaml
+  patch:
+  - op: add
+    path: /items/-
+    value: two
+    skipIfPresent: true
+- op: jsonPatch
+  key: list.yaml
+  patch:
+  - op: add
+    path: /-
+    value: two
+    skipIfPresent: true
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+data:
+  old.conf: port=80
+  config.yaml: |
+    items:
+    - one
+  list.yaml: |
+    - one
+`)
+	assert.Equal(t, first, second)
+	target := first[strings.Index(first, "kind: ConfigMap\n"):]
+	assert.Contains(t, target, "new.conf: port=80")
+	assert.Contains(t, target, "renamed.conf: level=debug")
+	assert.Contains(t, target, "    - one\n    - two\n")
+	assert.NotContains(t, target, "old.conf:")
+	assert.NotContains(t, target, "injected.conf:")
+}
+
+func TestConfigMapInjectorValidate(t *testing.T) {
+	var tests = []test{
+		{
+			name:        "valid content",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.json:
+    validate: json
+  app.properties:
+    validate: properties
+data:
+  config.json: |
+    {
+      "level": "{{ .level }}"
+    }
+  app.properties: |
+    # comment
+    log.level={{ .level }}
+    message=multi \
+      line \u00e9
+values:
+  level: debug
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: app.properties,config.json
+data:
+  app.properties: |
+    # comment
+    log.level=debug
+    message=multi \
+      line \u00e9
+  config.json: |
+    {
+      "level": "debug"
+    }
+`,
+		},
+		{
+			name:        "invalid json",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.json:
+    validate: json
+data:
+  config.json: |
+    {
+      "id": "v1",
+      "level": "{{ .level }}",
+    }
+values:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "data.config.json: invalid json: line 4, column 1: invalid character '}' looking for beginning of object key string",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "invalid toml",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.toml:
+    validate: toml
+data:
+  config.toml: |
+    [server]
+    port = {{ .port }}
+values:
+  port: ""
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "data.config.toml: invalid toml: line 2:",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "invalid properties",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  app.properties:
+    validate: properties
+data:
+  app.properties: |
+    a=b
+    =c
+values: {}
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "data.app.properties: invalid properties: line 2: missing key",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "schema",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.yaml:
+    validate:
+      schema:
+        required: [server]
+        properties:
+          server:
+            properties:
+              port:
+                type: integer
+data:
+  config.yaml:
+    server:
+      port: "8080"
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: "data.config.yaml: doesn't match schema: server.port must be of type integer, got string",
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+		{
+			name:        "unsupported validation",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: app-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  config.ini:
+    validate: ini
+data:
+  config.ini:
+    a: b
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+			errorMsg: `keys.config.ini.validate: unsupported format "ini"`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-cm
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorConflicts(t *testing.T) {
+	input := `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: first
+  first: value
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: "{{.level}}"
+values:
+  level: second
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+data:
+  level: existing
+`
+	var tests = []test{
+		{
+			name:        "warn by default",
+			resultCount: 3,
+			input:       input,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: first
+data:
+  first: |
+    value
+  level: second
+`,
+		},
+		{
+			name:        "last wins",
+			resultCount: 2,
+			input:       input,
+			config: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fn-config
+data:
+  conflictPolicy: lastWins
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: first
+data:
+  first: |
+    value
+  level: second
+`,
+		},
+		{
+			name:        "error",
+			resultCount: 2,
+			input:       input,
+			errorMsg:    `key "level" in ConfigMap some-cm is set by both ConfigMapInject some-cm`,
+			config: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInjector
+metadata:
+  name: fn-config
+conflictPolicy: error
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+data:
+  level: existing
+`,
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorChanges(t *testing.T) {
+	existing := `
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+data:
+  same: one
+  changed: |
+    first
+    second
+    third
+  removed: gone
+`
+	source := `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+behavior: replace
+keys:
+  same:
+    format: raw
+  changed:
+    format: raw
+  added:
+    format: raw
+data:
+  same: one
+  changed: |
+    first
+    2nd
+    third
+  added: new`
+	expected := `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: added
+data:
+  added: new
+  changed: |
+    first
+    2nd
+    third
+  same: one
+`
+	var tests = []test{
+		{
+			name:        "counts",
+			resultCount: 1,
+			input:       source + existing,
+			expected:    expected,
+			resultMessages: []string{
+				"ConfigMapInject some-cm -> some-cm with keys: [added changed same] " +
+					"(added: 1, changed: 1, unchanged: 1, removed: 1)",
+			},
+		},
+		{
+			name:        "generated target",
+			resultCount: 1,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  level: debug
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+`,
+			resultMessages: []string{"(added: 1, changed: 0, unchanged: 0, removed: 0)"},
+		},
+		{
+			name:        "generated target written by two sources",
+			resultCount: 3,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: first
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  name: some-cm
+data:
+  level: info
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: second
+  annotations:
+    config.kubernetes.io/local-config: "true"
+target:
+  name: some-cm
+data:
+  level: debug
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: |
+    debug
+`,
+			resultMessages: []string{
+				"ConfigMapInject first -> some-cm with keys: [level] (added: 1, changed: 0, unchanged: 0, removed: 0)",
+				"ConfigMapInject second -> some-cm with keys: [level] (added: 1, changed: 0, unchanged: 0, removed: 0)",
+			},
+		},
+		{
+			name:        "pruned keys",
+			resultCount: 2,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  level:
+    format: raw
+data:
+  level: debug
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level,old
+data:
+  level: debug
+  old: gone
+`,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+  annotations:
+    fn.kumorilabs.io/managed-keys: level
+data:
+  level: debug
+`,
+			resultMessages: []string{"(added: 0, changed: 0, unchanged: 1, removed: 1)"},
+		},
+		{
+			name:        "patch",
+			resultCount: 3,
+			input: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapPatch
+metadata:
+  name: some-cm
+  annotations:
+    config.kubernetes.io/local-config: "true"
+operations:
+- op: delete
+  key: removed
+- op: rename
+  key: same
+  to: renamed
+` + existing,
+			expected: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: some-cm
+data:
+  changed: |
+    first
+    second
+    third
+  renamed: one
+`,
+			resultMessages: []string{"(added: 1, changed: 0, unchanged: 0, removed: 2)"},
+		},
+		{
+			name:        "diff",
+			resultCount: 1,
+			config: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fn-config
+data:
+  diff: true
+`,
+			input:    source + existing,
+			expected: expected,
+			resultMessages: []string{`(added: 1, changed: 1, unchanged: 1, removed: 1)
+--- a/changed
++++ b/changed
+@@ -1,3 +1,3 @@
+ first
+-second
++2nd
+ third
+`},
+		},
+		{
+			name:        "truncated diff",
+			resultCount: 1,
+			config: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInjector
+metadata:
+  name: fn-config
+diff: true
+diffMaxBytes: 40
+`,
+			input:    source + existing,
+			expected: expected,
+			resultMessages: []string{`(added: 1, changed: 1, unchanged: 1, removed: 1)
+--- a/changed
++++ b/changed
+... truncated 43 bytes
+`},
+		},
+	}
+	runTests(t, tests)
+}
+
+func TestConfigMapInjectorSecretScalarValues(t *testing.T) {
+	dir := writePackage(t, `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretInject
+metadata:
+  name: creds
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  password: hunter2
+  port: 5432
+  credentials:
+    username: admin
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: creds
+`)
+	defer os.RemoveAll(dir)
+
+	nodes, err := kio.FromBytes([]byte(renderPackage(t, dir)))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var secret *yaml.RNode
+	for _, node := range nodes {
+		if node.GetKind() == kindSecret {
+			secret = node
+		}
+	}
+	if !assert.NotNil(t, secret) {
+		t.FailNow()
+	}
+	decoded := map[string]string{}
+	for key, val := range secret.GetDataMap() {
+		b, err := base64.StdEncoding.DecodeString(val)
+		assert.NoError(t, err)
+		decoded[key] = string(b)
+	}
+	assert.Equal(t, map[string]string{
+		"password":    "hunter2",
+		"port":        "5432",
+		"credentials": "username: admin\n",
+	}, decoded)
+}
+
+func TestConfigMapInjectorSchemaErrorsOmitValues(t *testing.T) {
+	input := `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretTemplate
+metadata:
+  name: creds
+  annotations:
+    config.kubernetes.io/local-config: "true"
+data:
+  password: "{{.password}}"
+values:
+  password: hunter2-super-secret
+  tier: gold-hunter2
+valuesSchema:
+  properties:
+    password:
+      pattern: ^[a-z]+$
+    tier:
+      enum: [free, paid]
+`
+	items, err := kio.FromBytes([]byte(input))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	injector := &ConfigMapInjector{}
+	_, err = injector.Filter(items)
+	if !assert.Error(t, err) {
+		t.FailNow()
+	}
+	results, resultsErr := injector.Results()
+	if !assert.NoError(t, resultsErr) {
+		t.FailNow()
+	}
+	messages := []string{err.Error()}
+	for _, result := range results {
+		messages = append(messages, result.Message)
+	}
+	all := strings.Join(messages, "\n")
+	assert.Contains(t, all, `values.password must match pattern "^[a-z]+$"`)
+	assert.Contains(t, all, "values.tier must be one of [free paid]")
+	assert.NotContains(t, all, "hunter2")
+}
+
+func TestConfigMapInjectorSecretDiff(t *testing.T) {
+	input := `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretInject
+metadata:
+  name: creds
+  annotations:
+    config.kubernetes.io/local-config: "true"
+keys:
+  password:
+    format: raw
+data:
+  password: hunter2-new
+---
+apiVersion: v1
+kind: Secret
+metadata:
+  name: creds
+type: Opaque
+data:
+  password: aHVudGVyMi1vbGQ=
+`
+	items, err := kio.FromBytes([]byte(input))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	injector := &ConfigMapInjector{Diff: true}
+	if _, err := injector.Filter(items); !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	results, err := injector.Results()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if !assert.Len(t, results, 1) {
+		t.FailNow()
+	}
+	msg := results[0].Message
+	assert.Contains(t, msg, "(added: 0, changed: 1, unchanged: 0, removed: 0)")
+	assert.Contains(t, msg, `Values of key "password" differ (redacted)`)
+	for _, secret := range []string{"hunter2", "aHVudGVyMi1vbGQ=", "aHVudGVyMi1uZXc="} {
+		assert.NotContains(t, msg, secret)
+	}
+}
+
+func TestTruncateDiff(t *testing.T) {
+	assert.Equal(t, "a\nb\n", truncateDiff("a\nb\n", 4))
+	assert.Equal(t, "a\n... truncated 5 bytes\n", truncateDiff("a\nbc\nd\n", 4))
+	assert.Equal(t, "ab... truncated 2 bytes\n", truncateDiff("abcd", 2))
+	assert.Equal(t, "a... truncated 3 bytes\n", truncateDiff("aé\n", 2))
+}
+
+func TestConfigMapInjectorOutputPath(t *testing.T) {
+	input := `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: default
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/path: app/inject.yaml
+    config.kubernetes.io/index: "0"
+data:
+  level: debug
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: annotated
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/path: app/inject.yaml
+    config.kubernetes.io/index: "1"
+    fn.kumorilabs.io/output-path: generated/configmaps.yaml
+data:
+  level: debug
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: targets
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/path: app/inject.yaml
+    config.kubernetes.io/index: "2"
+targets:
+- name: a
+  path: ./generated/configmaps.yaml
+- name: b
+data:
+  level: debug
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: SecretInject
+metadata:
+  name: creds
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/path: app/inject.yaml
+    config.kubernetes.io/index: "3"
+data:
+  password: secret
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: existing
+  annotations:
+    config.kubernetes.io/path: generated/configmaps.yaml
+    config.kubernetes.io/index: "0"
+`
+	items, err := kio.FromBytes([]byte(input))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	injector := &ConfigMapInjector{}
+	items, err = injector.Filter(items)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+
+	actual := map[string]string{}
+	for _, item := range items {
+		if item.GetKind() != kindConfigMap && item.GetKind() != kindSecret {
+			continue
+		}
+		path, index, err := kioutil.GetFileAnnotations(item)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		actual[item.GetKind()+" "+item.GetName()] = path + ":" + index
+		assert.NotContains(t, item.GetAnnotations(), annotationOutputPath, item.GetName())
+	}
+	assert.Equal(t, map[string]string{
+		"ConfigMap existing":  "generated/configmaps.yaml:0",
+		"ConfigMap default":   "app/configmap_default.yaml:0",
+		"ConfigMap annotated": "generated/configmaps.yaml:1",
+		"ConfigMap a":         "generated/configmaps.yaml:2",
+		"ConfigMap b":         "app/configmap_b.yaml:0",
+		"Secret creds":        "app/secret_creds.yaml:0",
+	}, actual)
+
+	// results point at the generated files
+	results, err := injector.Results()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var files []string
+	for _, result := range results {
+		files = append(files, fmt.Sprintf("%s:%d", result.File.Path, result.File.Index))
+	}
+	assert.ElementsMatch(t, []string{
+		"app/configmap_default.yaml:0",
+		"generated/configmaps.yaml:1",
+		"generated/configmaps.yaml:2",
+		"app/configmap_b.yaml:0",
+		"app/secret_creds.yaml:0",
+	}, files)
+}
+
+func TestConfigMapInjectorContinueOnError(t *testing.T) {
+	input := `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: bad-template
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/path: templates.yaml
+    config.kubernetes.io/index: "0"
+data:
+  config.json: '{"url": "{{.url}}"}'
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapTemplate
+metadata:
+  name: bad-values
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/path: templates.yaml
+    config.kubernetes.io/index: "1"
+valuesFrom:
+- name: host
+  resource:
+    kind: Service
+    name: db
+  fieldPath: metadata.name
+data:
+  host: "{{.host}}"
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: good
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/path: inject.yaml
+    config.kubernetes.io/index: "0"
+data:
+  level: debug
+---
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInject
+metadata:
+  name: missing
+  annotations:
+    config.kubernetes.io/local-config: "true"
+    config.kubernetes.io/path: inject.yaml
+    config.kubernetes.io/index: "1"
+behavior: mustExist
+data:
+  level: debug
+`
+	items, err := kio.FromBytes([]byte(input))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	injector := &ConfigMapInjector{}
+	_, err = injector.Filter(items)
+	if !assert.Error(t, err) {
+		t.FailNow()
+	}
+	assert.Contains(t, err.Error(), "3 sources failed")
+
+	results, err := injector.Results()
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	type summary struct {
+		severity framework.Severity
+		name     string
+		path     string
+		file     string
+		index    int
+	}
+	var actual []summary
+	for _, result := range results {
+		s := summary{severity: result.Severity}
+		if result.File != nil {
+			s.file, s.index = result.File.Path, result.File.Index
+		}
+		if result.ResourceRef != nil {
+			s.name = result.ResourceRef.Name
+		}
+		if result.Field != nil {
+			s.path = result.Field.Path
+		}
+		actual = append(actual, s)
+	}
+	assert.Equal(t, []summary{
+		{severity: framework.Info},
+		{severity: framework.Error, name: "bad-template", path: "data.config.json", file: "templates.yaml"},
+		{severity: framework.Error, name: "bad-values", path: "valuesFrom[0]", file: "templates.yaml", index: 1},
+		{severity: framework.Error, name: "missing", file: "inject.yaml", index: 1},
+	}, actual)
+	// the generated target of the source that succeeded isn't written
+	assert.Contains(t, results[0].Message, "not written because the run failed")
+	assert.Nil(t, results[3].Field)
+}
+
+func TestNew(t *testing.T) {
+	var tests = []struct {
+		name     string
+		config   string
+		errorMsg string
+	}{
+		{
+			name: "configmap",
+			config: `
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fn-config
+data:
+  conflictPolicy: error
+`,
+		},
+		{
+			name: "invalid conflict policy",
+			config: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInjector
+metadata:
+  name: fn-config
+conflictPolicy: firstWins
+`,
+			errorMsg: "conflictPolicy must be one of",
+		},
+		{
+			name: "negative diff max bytes",
+			config: `
+apiVersion: fn.kumorilabs.io/v1alpha1
+kind: ConfigMapInjector
+metadata:
+  name: fn-config
+diffMaxBytes: -1
+`,
+			errorMsg: "diffMaxBytes must not be negative, got -1",
+		},
+		{
+			name:   "empty",
+			config: `{}`,
+		},
+		{
+			name: "other kind is ignored",
+			config: `
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  annotations:
+    config.kubernetes.io/function: |
+      container:
+        image: ghcr.io/kumorilabs/krm-fn-configmap-injector
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fnconfig, err := yaml.Parse(test.config)
+			if !assert.NoError(t, err, test.name) {
+				t.FailNow()
+			}
+			_, err = New(fnconfig)
+			if test.errorMsg == "" {
+				assert.NoError(t, err, test.name)
+				return
+			}
+			if assert.Error(t, err, test.name) {
+				assert.Contains(t, err.Error(), test.errorMsg)
+			}
+		})
+	}
+}
+
+func TestNewConfigMapStrings(t *testing.T) {
+	fnconfig, err := yaml.Parse(`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: fn-config
+data:
+  diff: "true"
+  diffMaxBytes: "100"
+  profile: "true"
+`)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	injector, err := New(fnconfig)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	assert.True(t, injector.Diff)
+	assert.Equal(t, 100, injector.DiffMaxBytes)
+	assert.Equal(t, "true", injector.Profile)
+}
+
+func runTests(t *testing.T, tests []test) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baseDir, err := ioutil.TempDir("", "")
+			if !assert.NoError(t, err, test.name) {
+				t.FailNow()
+			}
+			defer os.RemoveAll(baseDir)
+
+			r, err := ioutil.TempFile(baseDir, "k8s-cli-*.yaml")
+			if !assert.NoError(t, err, test.name) {
+				t.FailNow()
+			}
+			defer os.Remove(r.Name())
+			err = ioutil.WriteFile(r.Name(), []byte(test.input), 0600)
+			if !assert.NoError(t, err, test.name) {
+				t.FailNow()
+			}
+
+			targets := &framework.Selector{
+				Kinds: []string{kindConfigMap, kindSecret, "Deployment", "CronJob", "Pod"},
+			}
+
+			var fnconfig *yaml.RNode
+			if test.config != "" {
+				fnconfig, err = yaml.Parse(test.config)
+				if !assert.NoError(t, err, test.name) {
+					t.FailNow()
+				}
+			}
+			injector, err := New(fnconfig)
+			if !assert.NoError(t, err, test.name) {
+				t.FailNow()
+			}
+			inout := &kio.LocalPackageReadWriter{
+				PackagePath: baseDir,
+			}
+			err = kio.Pipeline{
+				Inputs:  []kio.Reader{inout},
+				Filters: []kio.Filter{injector},
+				Outputs: []kio.Writer{inout},
+			}.Execute()
+
+			if test.errorMsg != "" {
+				if !assert.NotNil(t, err, test.name) {
+					t.FailNow()
+				}
+				if !assert.Contains(t, err.Error(), test.errorMsg) {
+					t.FailNow()
+				}
+			}
+
+			if test.errorMsg == "" && !assert.NoError(t, err, test.name) {
+				t.FailNow()
+			}
+
+			// get results
+			results, err := injector.Results()
+			if !assert.NoError(t, err, test.name, test.name) {
+				t.FailNow()
+			}
+			if !assert.Equal(t, test.resultCount, len(results), test.name) {
+				t.FailNow()
+			}
+			var messages []string
+			for _, result := range results {
+				messages = append(messages, result.Message)
+			}
+			for _, msg := range test.resultMessages {
+				assert.Contains(t, strings.Join(messages, "\n"), msg, test.name)
+			}
+
+			// filter to just targets so we can compare expected more easily
+			err = kio.Pipeline{
+				Inputs:  []kio.Reader{inout},
+				Filters: []kio.Filter{targets},
+				Outputs: []kio.Writer{inout},
+			}.Execute()
+			if !assert.NoError(t, err, test.name) {
+				t.FailNow()
+			}
+
+			if !assert.Equal(t,
+				strings.TrimSpace(test.expected),
+				readPackage(t, baseDir)) {
+				t.FailNow()
+			}
+		})
+	}
+}
+
+// readPackage returns the resources of all files of a package, since
+// generated targets are written to their own files.
+func readPackage(t *testing.T, dir string) string {
+	files, err := ioutil.ReadDir(dir)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	var contents []string
+	for _, file := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		if content := strings.TrimSpace(string(content)); content != "" {
+			contents = append(contents, content)
+		}
+	}
+	return strings.Join(contents, "\n---\n")
+}
+
+// renderTwice runs the function on a package, then again on its own output
+// like repeated kpt fn render runs, and returns the package after each run.
+func renderTwice(t *testing.T, input string) (string, string) {
+	dir := writePackage(t, input)
+	defer os.RemoveAll(dir)
+	first := renderPackage(t, dir)
+	return first, renderPackage(t, dir)
+}
+
+// writePackage writes a package with a single file holding input to a new
+// directory.
+func writePackage(t *testing.T, input string) string {
+	dir, err := ioutil.TempDir("", "")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "package.yaml"), []byte(input), 0600); !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return dir
+}
+
+// renderPackage runs the function on a package in place and returns the
+// package.
+func renderPackage(t *testing.T, dir string) string {
+	inout := &kio.LocalPackageReadWriter{PackagePath: dir}
+	err := kio.Pipeline{
+		Inputs:  []kio.Reader{inout},
+		Filters: []kio.Filter{&ConfigMapInjector{}},
+		Outputs: []kio.Writer{inout},
+	}.Execute()
+	if !assert.NoError(t, err) {
+		t.FailNow()
 	}
+	return readPackage(t, dir)
 }
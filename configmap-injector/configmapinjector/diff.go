@@ -0,0 +1,180 @@
+package configmapinjector
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// defaultDiffMaxBytes is the size a diff is truncated to unless diffMaxBytes
+// is set.
+const defaultDiffMaxBytes = 4096
+
+// keyChanges sorts the keys touched by an injection by how their values
+// changed.
+type keyChanges struct {
+	Added     []string
+	Changed   []string
+	Unchanged []string
+	Removed   []string
+	// Diff is the unified diff of the changed keys
+	Diff string
+}
+
+func (c *keyChanges) String() string {
+	return fmt.Sprintf(
+		"added: %d, changed: %d, unchanged: %d, removed: %d",
+		len(c.Added), len(c.Changed), len(c.Unchanged), len(c.Removed),
+	)
+}
+
+// recordChanges records on the result of an injection the changes of the
+// target's values compared to the input, where a generated target has no
+// values. Keys of the input count as removed when the injection removed them
+// from before, the target as left by the previous injection.
+func (i *ConfigMapInjector) recordChanges(result *injectResult, before, after *yaml.RNode) error {
+	var previous map[string]string
+	if before != nil {
+		var err error
+		if previous, err = targetValues(before); err != nil {
+			return err
+		}
+	}
+	current, err := targetValues(after)
+	if err != nil {
+		return err
+	}
+	input := i.inputValues[targetID(after.GetKind(), after.GetNamespace(), baseName(after))]
+	result.Changes = diffValues(input, previous, current, result.Keys, after.GetKind() == kindSecret)
+	return nil
+}
+
+// recordPrune counts the keys pruned from a target as removed by the last
+// injection into it, if any.
+func (i *ConfigMapInjector) recordPrune(target *yaml.RNode, keys []string) {
+	for idx := len(i.injectResults) - 1; idx >= 0; idx-- {
+		result := i.injectResults[idx]
+		if result.Target != target || result.Changes == nil {
+			continue
+		}
+		result.Changes.Removed = append(result.Changes.Removed, keys...)
+		sort.Strings(result.Changes.Removed)
+		return
+	}
+}
+
+// diffValues sorts the given keys by how their values changed between input
+// and current. Keys of input that were in previous but are missing from
+// current are removed. The diff of redacted values only names the changed
+// keys.
+func diffValues(input, previous, current map[string]string, keys []string, redact bool) *keyChanges {
+	changes := &keyChanges{}
+	var diff strings.Builder
+	for _, key := range keys {
+		oldVal, inOld := input[key]
+		newVal, inNew := current[key]
+		switch {
+		case !inNew:
+		case !inOld:
+			changes.Added = append(changes.Added, key)
+		case oldVal == newVal:
+			changes.Unchanged = append(changes.Unchanged, key)
+		default:
+			changes.Changed = append(changes.Changed, key)
+			if redact {
+				fmt.Fprintf(&diff, "Values of key %q differ (redacted)\n", key)
+			} else {
+				diff.WriteString(diffValue(key, oldVal, newVal))
+			}
+		}
+	}
+	for _, key := range yaml.SortedMapKeys(input) {
+		_, inPrevious := previous[key]
+		if _, inNew := current[key]; inPrevious && !inNew {
+			changes.Removed = append(changes.Removed, key)
+		}
+	}
+	changes.Diff = diff.String()
+	return changes
+}
+
+// diffValue returns the unified diff of the old and new values of a key.
+func diffValue(key, oldVal, newVal string) string {
+	if !utf8.ValidString(oldVal) || !utf8.ValidString(newVal) {
+		return fmt.Sprintf("Binary values of key %q differ\n", key)
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(oldVal),
+		B:        splitLines(newVal),
+		FromFile: "a/" + key,
+		ToFile:   "b/" + key,
+		Context:  3,
+	})
+	if err != nil {
+		return fmt.Sprintf("Values of key %q differ\n", key)
+	}
+	return diff
+}
+
+// splitLines splits a value into lines ending with a newline. Unlike
+// difflib.SplitLines, a value ending with a newline has no extra empty line.
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(s, "\n"), "\n")
+	lines[len(lines)-1] += "\n"
+	return lines
+}
+
+// truncateDiff truncates a diff to at most max bytes, at a line boundary if
+// possible, noting how much was cut.
+func truncateDiff(diff string, max int) string {
+	if len(diff) <= max {
+		return diff
+	}
+	cut := strings.LastIndex(diff[:max], "\n") + 1
+	if cut == 0 {
+		cut = max
+		for cut > 0 && !utf8.RuneStart(diff[cut]) {
+			cut--
+		}
+	}
+	return fmt.Sprintf("%s... truncated %d bytes\n", diff[:cut], len(diff)-cut)
+}
+
+// targetValues returns the decoded values of all keys of a ConfigMap or
+// Secret, so that a key moving between data fields with the same content is
+// unchanged.
+func targetValues(target *yaml.RNode) (map[string]string, error) {
+	values := map[string]string{}
+	decoded := func(m map[string]string) {
+		for key, val := range m {
+			if b, err := base64.StdEncoding.DecodeString(val); err == nil {
+				val = string(b)
+			}
+			values[key] = val
+		}
+	}
+	if target.GetKind() == kindSecret {
+		decoded(target.GetDataMap())
+	} else {
+		for key, val := range target.GetDataMap() {
+			values[key] = val
+		}
+	}
+	decoded(target.GetBinaryDataMap())
+	stringData, err := getStringData(target)
+	if err != nil {
+		return nil, err
+	}
+	for key, val := range stringData {
+		values[key] = val
+	}
+	return values, nil
+}
@@ -0,0 +1,229 @@
+package configmapinjector
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	fieldForEach     = "forEach"
+	defaultForEachAs = "item"
+)
+
+// ForEach renders a template source once per element of a list in its values.
+// It is either the path of the list, or a map that also names the value
+// holding the current element:
+//
+//	forEach: tenants
+//	forEach:
+//	  values: tenants
+//	  as: tenant
+type ForEach struct {
+	// Values is the dotted path of the list in the template values.
+	Values string `json:"values" yaml:"values"`
+	// As is the name of the template value holding the current element. It
+	// defaults to "item".
+	As string `json:"as,omitempty" yaml:"as,omitempty"`
+}
+
+// emptyForEach is a source whose forEach list is empty, so it renders
+// nothing.
+type emptyForEach struct {
+	Source *yaml.RNode
+	Values string
+}
+
+// forEachElement is the element of a forEach list being rendered.
+type forEachElement struct {
+	Index  int
+	Values map[string]interface{}
+}
+
+// renderContext is the state a source is rendered with.
+type renderContext struct {
+	// items are the resources as of the element being rendered, used to
+	// resolve libraries, templateValues and valuesFrom references
+	items []*yaml.RNode
+	// element is the forEach element being rendered, if any
+	element *forEachElement
+	// elementKeys tracks the forEach element that generated each key of the
+	// source, to detect collisions
+	elementKeys map[string]int
+}
+
+// UnmarshalYAML accepts the path of the list as well as a map.
+func (f *ForEach) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		f.Values = node.Value
+		return nil
+	}
+	type forEach ForEach
+	return node.Decode((*forEach)(f))
+}
+
+// getForEach returns the forEach of a template source, or nil if the source
+// doesn't have one.
+func getForEach(source *yaml.RNode) (*ForEach, error) {
+	if source.GetKind() != kindTemplate && source.GetKind() != kindSecretTemplate {
+		return nil, nil
+	}
+	node, err := source.Pipe(yaml.Lookup(fieldForEach))
+	if err != nil || node == nil {
+		return nil, err
+	}
+	forEach := &ForEach{}
+	if err := node.YNode().Decode(forEach); err != nil {
+		return nil, fmt.Errorf("%s %s: unable to decode %s: %w", source.GetKind(), source.GetName(), fieldForEach, err)
+	}
+	if forEach.Values == "" {
+		return nil, fmt.Errorf("%s %s: %s.values is required", source.GetKind(), source.GetName(), fieldForEach)
+	}
+	if forEach.As == "" {
+		forEach.As = defaultForEachAs
+	}
+	return forEach, nil
+}
+
+// forEachElements returns the elements a source is rendered for: one per
+// element of its forEach list, or a single nil element if the source doesn't
+// have a forEach.
+func (i *ConfigMapInjector) forEachElements(ctx *renderContext, source *yaml.RNode) ([]*forEachElement, error) {
+	forEach, err := getForEach(source)
+	if err != nil {
+		return nil, err
+	}
+	if forEach == nil {
+		return []*forEachElement{nil}, nil
+	}
+
+	values, _, err := i.templateValues(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", source.GetKind(), source.GetName(), err)
+	}
+	var val interface{} = values
+	for _, part := range strings.Split(forEach.Values, ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			val = nil
+			break
+		}
+		val = m[part]
+	}
+	list, ok := val.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf(
+			"%s %s: %s: values.%s must be a list, got %s",
+			source.GetKind(), source.GetName(), fieldForEach, forEach.Values, schemaType(val),
+		)
+	}
+
+	if len(list) == 0 {
+		i.emptyForEach = append(i.emptyForEach, &emptyForEach{Source: source, Values: forEach.Values})
+	}
+	elements := make([]*forEachElement, 0, len(list))
+	for idx, elem := range list {
+		elements = append(elements, &forEachElement{
+			Index:  idx,
+			Values: map[string]interface{}{forEach.As: elem},
+		})
+	}
+	return elements, nil
+}
+
+// renderTargetRefs renders the names, namespaces, label selectors and paths of
+// the targets of a source for the current forEach element, so that each
+// element can generate or select its own target.
+func (i *ConfigMapInjector) renderTargetRefs(ctx *renderContext, source *yaml.RNode, refs []TargetRef) ([]TargetRef, error) {
+	if ctx.element == nil {
+		return refs, nil
+	}
+	values, _, err := i.templateValues(ctx, source)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", source.GetKind(), source.GetName(), err)
+	}
+	funcs := templateFuncs(false)
+
+	rendered := make([]TargetRef, 0, len(refs))
+	for _, ref := range refs {
+		for _, field := range []*string{&ref.Name, &ref.Namespace, &ref.LabelSelector, &ref.Path} {
+			val, err := renderString(*field, values, funcs)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"%s %s: %s[%d]: target: %w",
+					source.GetKind(), source.GetName(), fieldForEach, ctx.element.Index, err,
+				)
+			}
+			*field = val
+		}
+		rendered = append(rendered, ref)
+	}
+	return rendered, nil
+}
+
+// renderKeys renders the names of the keys of a template source for the
+// current forEach element. It returns the rendered data and the key options
+// of the rendered names.
+func (i *ConfigMapInjector) renderKeys(
+	ctx *renderContext,
+	target *yaml.RNode,
+	data map[string]string,
+	options map[string]KeyOptions,
+	values map[string]interface{},
+	funcs template.FuncMap,
+) (map[string]string, map[string]KeyOptions, error) {
+	if ctx.element == nil {
+		return data, options, nil
+	}
+
+	renderedData := map[string]string{}
+	renderedOptions := map[string]KeyOptions{}
+	renderedFrom := map[string]string{}
+	for _, key := range yaml.SortedMapKeys(data) {
+		name, err := renderString(key, values, funcs)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s[%d]: key %q: %w", fieldForEach, ctx.element.Index, key, err)
+		}
+		if previous, ok := renderedFrom[name]; ok {
+			return nil, nil, fmt.Errorf(
+				"%s[%d]: keys %q and %q both render to %q",
+				fieldForEach, ctx.element.Index, previous, key, name,
+			)
+		}
+		renderedFrom[name] = key
+
+		id := targetID(target.GetKind(), target.GetNamespace(), baseName(target)) + "/" + name
+		if previous, ok := ctx.elementKeys[id]; ok && previous != ctx.element.Index {
+			return nil, nil, fmt.Errorf(
+				"%s: elements %d and %d both generate key %q in %s %s",
+				fieldForEach, previous, ctx.element.Index, name, target.GetKind(), target.GetName(),
+			)
+		}
+		ctx.elementKeys[id] = ctx.element.Index
+
+		renderedData[name] = data[key]
+		if opts, ok := options[key]; ok {
+			renderedOptions[name] = opts
+		}
+	}
+	return renderedData, renderedOptions, nil
+}
+
+// renderString renders a template string with the given values.
+func renderString(text string, values map[string]interface{}, funcs template.FuncMap) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New("").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, values); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,452 @@
+package configmapinjector
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	fieldFormat   = "format"
+	fieldComments = "comments"
+	fieldKeys     = "keys"
+)
+
+// Format is a serialization format for injected values.
+type Format string
+
+const (
+	FormatYAML       Format = "yaml"
+	FormatJSON       Format = "json"
+	FormatJSONPretty Format = "json-pretty"
+	FormatProperties Format = "properties"
+	FormatEnv        Format = "env"
+	FormatINI        Format = "ini"
+	FormatTOML       Format = "toml"
+	FormatRaw        Format = "raw"
+)
+
+// CommentMode controls whether comments in structured values are injected.
+type CommentMode string
+
+const (
+	CommentsStrip CommentMode = "strip"
+	CommentsKeep  CommentMode = "keep"
+)
+
+var (
+	formats = []Format{
+		FormatYAML,
+		FormatJSON,
+		FormatJSONPretty,
+		FormatProperties,
+		FormatEnv,
+		FormatINI,
+		FormatTOML,
+		FormatRaw,
+	}
+	envKeyInvalidChars = regexp.MustCompile(`[^A-Za-z0-9_]`)
+	envValueSafe       = regexp.MustCompile(`^[A-Za-z0-9_./:@,+-]*$`)
+)
+
+// KeyOptions are per-key settings of a source. They are set in the source's
+// "keys" map and take precedence over the source-level settings.
+type KeyOptions struct {
+	Format        Format        `json:"format,omitempty" yaml:"format,omitempty"`
+	Comments      CommentMode   `json:"comments,omitempty" yaml:"comments,omitempty"`
+	MergeStrategy MergeStrategy `json:"mergeStrategy,omitempty" yaml:"mergeStrategy,omitempty"`
+	MergeKey      string        `json:"mergeKey,omitempty" yaml:"mergeKey,omitempty"`
+	Validate      *Validation   `json:"validate,omitempty" yaml:"validate,omitempty"`
+	// Gzip compresses the value, which is written to binaryData
+	Gzip bool `json:"gzip,omitempty" yaml:"gzip,omitempty"`
+}
+
+// getKeyOptions returns the per-key settings of a source.
+func getKeyOptions(source *yaml.RNode) (map[string]KeyOptions, error) {
+	options := map[string]KeyOptions{}
+	node, err := source.Pipe(yaml.Lookup(fieldKeys))
+	if err != nil || node == nil {
+		return options, err
+	}
+	yamlstr, err := node.String()
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal([]byte(yamlstr), &options); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %s: %w", fieldKeys, err)
+	}
+	for key, opts := range options {
+		if err := validateFormat(opts.Format); err != nil {
+			return nil, fmt.Errorf("%s.%s.%s: %w", fieldKeys, key, fieldFormat, err)
+		}
+		if err := validateCommentMode(opts.Comments); err != nil {
+			return nil, fmt.Errorf("%s.%s.%s: %w", fieldKeys, key, fieldComments, err)
+		}
+		if err := validateMergeStrategy(opts.MergeStrategy); err != nil {
+			return nil, fmt.Errorf("%s.%s.mergeStrategy: %w", fieldKeys, key, err)
+		}
+		if opts.Validate != nil {
+			if err := opts.Validate.compile(fmt.Sprintf("%s.%s.%s", fieldKeys, key, fieldValidate)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return options, nil
+}
+
+// sourceFormat returns the default format of a source's keys, which is empty
+// when the source doesn't set one.
+func sourceFormat(source *yaml.RNode) (Format, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldFormat))
+	if err != nil {
+		return "", err
+	}
+	if node == nil || node.YNode().Value == "" {
+		return "", nil
+	}
+	format := Format(node.YNode().Value)
+	if err := validateFormat(format); err != nil {
+		return "", fmt.Errorf("%s: %w", fieldFormat, err)
+	}
+	return format, nil
+}
+
+// defaultFormat returns the format of a value whose source and key don't set
+// one. Scalar values of a Secret are written verbatim, so that a password
+// doesn't end with the newline of a YAML document.
+func defaultFormat(source, value *yaml.RNode) Format {
+	if source.GetKind() == kindSecretInject && value.YNode().Kind == yaml.ScalarNode {
+		return FormatRaw
+	}
+	return FormatYAML
+}
+
+// sourceCommentMode returns the default comment mode of a source's keys.
+func sourceCommentMode(source *yaml.RNode) (CommentMode, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldComments))
+	if err != nil {
+		return "", err
+	}
+	if node == nil || node.YNode().Value == "" {
+		return CommentsStrip, nil
+	}
+	mode := CommentMode(node.YNode().Value)
+	if err := validateCommentMode(mode); err != nil {
+		return "", fmt.Errorf("%s: %w", fieldComments, err)
+	}
+	return mode, nil
+}
+
+func validateCommentMode(mode CommentMode) error {
+	switch mode {
+	case "", CommentsStrip, CommentsKeep:
+		return nil
+	default:
+		return fmt.Errorf("unsupported comment mode %q, must be %q or %q", mode, CommentsStrip, CommentsKeep)
+	}
+}
+
+func validateFormat(format Format) error {
+	if format == "" {
+		return nil
+	}
+	for _, f := range formats {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported format %q, must be one of %v", format, formats)
+}
+
+// encode serializes the value node using the given format. YAML and JSON are
+// serialized straight from the node so the order of map keys is preserved.
+// Comments are only kept for YAML when mode is CommentsKeep.
+func encode(format Format, mode CommentMode, node *yaml.RNode) (string, error) {
+	if format == FormatRaw {
+		if node.YNode().Kind != yaml.ScalarNode {
+			return "", fmt.Errorf("format %q only supports scalar values", format)
+		}
+		return node.YNode().Value, nil
+	}
+
+	node = node.Copy()
+	if err := node.DeAnchor(); err != nil {
+		return "", err
+	}
+
+	switch format {
+	case FormatYAML, "":
+		if mode != CommentsKeep {
+			stripComments(node.YNode())
+		}
+		var buf bytes.Buffer
+		if err := yaml.NewEncoder(&buf).Encode(node.YNode()); err != nil {
+			return "", err
+		}
+		return buf.String(), nil
+	case FormatJSON:
+		var buf bytes.Buffer
+		err := encodeJSON(&buf, node.YNode())
+		return buf.String(), err
+	case FormatJSONPretty:
+		var compact, buf bytes.Buffer
+		if err := encodeJSON(&compact, node.YNode()); err != nil {
+			return "", err
+		}
+		if err := json.Indent(&buf, compact.Bytes(), "", "  "); err != nil {
+			return "", err
+		}
+		return buf.String() + "\n", nil
+	}
+
+	var val interface{}
+	if err := node.YNode().Decode(&val); err != nil {
+		return "", err
+	}
+
+	switch format {
+	case FormatProperties:
+		return encodeProperties(val)
+	case FormatEnv:
+		return encodeEnv(val)
+	case FormatINI:
+		return encodeINI(val)
+	default:
+		return encodeTOML(val)
+	}
+}
+
+func stripComments(node *yaml.Node) {
+	node.HeadComment = ""
+	node.LineComment = ""
+	node.FootComment = ""
+	for _, child := range node.Content {
+		stripComments(child)
+	}
+}
+
+// encodeJSON writes node as compact JSON, keeping the order of map keys.
+func encodeJSON(buf *bytes.Buffer, node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			buf.WriteString("null")
+			return nil
+		}
+		return encodeJSON(buf, node.Content[0])
+	case yaml.AliasNode:
+		return encodeJSON(buf, node.Alias)
+	case yaml.MappingNode:
+		buf.WriteString("{")
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			key, err := json.Marshal(node.Content[i].Value)
+			if err != nil {
+				return err
+			}
+			buf.Write(key)
+			buf.WriteString(":")
+			if err := encodeJSON(buf, node.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("}")
+	case yaml.SequenceNode:
+		buf.WriteString("[")
+		for i, elem := range node.Content {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			if err := encodeJSON(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("]")
+	default:
+		// numbers are written as they are in the document, like 1.50
+		tag := node.ShortTag()
+		if (tag == yaml.NodeTagInt || tag == yaml.NodeTagFloat) && json.Valid([]byte(node.Value)) {
+			buf.WriteString(node.Value)
+			return nil
+		}
+		var val interface{}
+		if err := node.Decode(&val); err != nil {
+			return err
+		}
+		b, err := json.Marshal(val)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+	}
+	return nil
+}
+
+// flatten flattens nested maps and lists into a map of keys joined with sep.
+// List elements are keyed by their index, either as a separate key or in
+// brackets (key[0]).
+func flatten(prefix, sep string, brackets bool, val interface{}, result map[string]string) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + sep + key
+	}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, elem := range v {
+			flatten(join(key), sep, brackets, elem, result)
+		}
+	case []interface{}:
+		for idx, elem := range v {
+			key := join(strconv.Itoa(idx))
+			if brackets {
+				key = fmt.Sprintf("%s[%d]", prefix, idx)
+			}
+			flatten(key, sep, brackets, elem, result)
+		}
+	case nil:
+		result[prefix] = ""
+	default:
+		result[prefix] = fmt.Sprint(v)
+	}
+}
+
+func topLevelMap(format Format, val interface{}) (map[string]interface{}, error) {
+	m, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("format %q requires a map, got %T", format, val)
+	}
+	return m, nil
+}
+
+func encodeProperties(val interface{}) (string, error) {
+	m, err := topLevelMap(FormatProperties, val)
+	if err != nil {
+		return "", err
+	}
+	flat := map[string]string{}
+	flatten("", ".", true, m, flat)
+
+	var buf bytes.Buffer
+	for _, key := range yaml.SortedMapKeys(flat) {
+		fmt.Fprintf(&buf, "%s=%s\n", escapeProperty(key, true), escapeProperty(flat[key], false))
+	}
+	return buf.String(), nil
+}
+
+func escapeProperty(s string, isKey bool) string {
+	var buf strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			buf.WriteString(`\\`)
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case isKey && strings.ContainsRune("=: #!", r):
+			buf.WriteRune('\\')
+			buf.WriteRune(r)
+		case !isKey && i == 0 && r == ' ':
+			buf.WriteString(`\ `)
+		default:
+			buf.WriteRune(r)
+		}
+	}
+	return buf.String()
+}
+
+func encodeEnv(val interface{}) (string, error) {
+	m, err := topLevelMap(FormatEnv, val)
+	if err != nil {
+		return "", err
+	}
+	flat := map[string]string{}
+	flatten("", "_", false, m, flat)
+
+	vars := map[string]string{}
+	for key, value := range flat {
+		name := envKeyInvalidChars.ReplaceAllString(key, "_")
+		if _, ok := vars[name]; ok {
+			return "", fmt.Errorf("format %q: multiple keys map to variable %s", FormatEnv, name)
+		}
+		vars[name] = value
+	}
+
+	var buf bytes.Buffer
+	for _, name := range yaml.SortedMapKeys(vars) {
+		fmt.Fprintf(&buf, "%s=%s\n", name, quoteEnv(vars[name]))
+	}
+	return buf.String(), nil
+}
+
+func quoteEnv(s string) string {
+	if envValueSafe.MatchString(s) {
+		return s
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, `$`, `\$`)
+	return `"` + r.Replace(s) + `"`
+}
+
+func encodeINI(val interface{}) (string, error) {
+	m, err := topLevelMap(FormatINI, val)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		buf      bytes.Buffer
+		sections []string
+		global   = map[string]string{}
+	)
+	for key, elem := range m {
+		if _, ok := elem.(map[string]interface{}); ok {
+			sections = append(sections, key)
+			continue
+		}
+		flatten(key, ".", true, elem, global)
+	}
+	sort.Strings(sections)
+
+	for _, key := range yaml.SortedMapKeys(global) {
+		fmt.Fprintf(&buf, "%s = %s\n", key, global[key])
+	}
+	for _, section := range sections {
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		fmt.Fprintf(&buf, "[%s]\n", section)
+		flat := map[string]string{}
+		flatten("", ".", true, m[section], flat)
+		for _, key := range yaml.SortedMapKeys(flat) {
+			fmt.Fprintf(&buf, "%s = %s\n", key, flat[key])
+		}
+	}
+	return buf.String(), nil
+}
+
+func encodeTOML(val interface{}) (string, error) {
+	m, err := topLevelMap(FormatTOML, val)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	enc := toml.NewEncoder(&buf)
+	enc.Indent = ""
+	if err := enc.Encode(m); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,78 @@
+package configmapinjector
+
+import (
+	"errors"
+	"strings"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const fieldNondeterministicFuncs = "nondeterministicFuncs"
+
+// nondeterministicFuncs are Sprig functions that return a different result on
+// every run or depend on the environment, in addition to the ones Sprig
+// already considers non-hermetic.
+var nondeterministicFuncs = []string{
+	"ago",
+	"randInt",
+	"shuffle",
+	"bcrypt",
+	"htpasswd",
+	"encryptAES",
+	"genPrivateKey",
+	"genCA",
+	"genCAWithKey",
+	"genSelfSignedCert",
+	"genSelfSignedCertWithKey",
+	"genSignedCert",
+	"genSignedCertWithKey",
+}
+
+// templateFuncs returns the functions available to templates: the Sprig
+// function library and the Helm functions to render structured values.
+// Nondeterministic functions are only included when enabled, so that
+// rendering the same package twice gives the same result.
+func templateFuncs(nondeterministic bool) template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	if !nondeterministic {
+		funcs = sprig.HermeticTxtFuncMap()
+		for _, name := range nondeterministicFuncs {
+			delete(funcs, name)
+		}
+	}
+	funcs["toYaml"] = toYAML
+	funcs["fromYaml"] = fromYAML
+	funcs["required"] = required
+	return funcs
+}
+
+// toYAML serializes a value as YAML without a trailing newline so that it can
+// be used with indent and nindent.
+func toYAML(val interface{}) (string, error) {
+	b, err := yaml.Marshal(val)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+func fromYAML(str string) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+	if err := yaml.Unmarshal([]byte(str), &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// required fails the template with msg if val is nil or an empty string.
+func required(msg string, val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, errors.New(msg)
+	}
+	if s, ok := val.(string); ok && s == "" {
+		return nil, errors.New(msg)
+	}
+	return val, nil
+}
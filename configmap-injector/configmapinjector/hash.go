@@ -0,0 +1,206 @@
+package configmapinjector
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/kustomize/api/hasher"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	fieldHashSuffix = "hashSuffix"
+	// annotationBaseName records the name of a target before its hash suffix
+	// was appended so that it can be found again on the next run.
+	annotationBaseName = annotationPrefixFn + "base-name"
+)
+
+// podSpecPaths are the paths to pod specs in workload resources.
+var podSpecPaths = [][]string{
+	{"spec", "template", "spec"},
+	{"spec", "jobTemplate", "spec", "template", "spec"},
+}
+
+// refPaths are the paths to ConfigMap and Secret names in a pod spec,
+// relative to a container, a volume or a projected volume source.
+var refPaths = map[string]struct {
+	env       []string
+	envFrom   []string
+	volume    []string
+	projected []string
+}{
+	kindConfigMap: {
+		env:       []string{"valueFrom", "configMapKeyRef", "name"},
+		envFrom:   []string{"configMapRef", "name"},
+		volume:    []string{"configMap", "name"},
+		projected: []string{"configMap", "name"},
+	},
+	kindSecret: {
+		env:       []string{"valueFrom", "secretKeyRef", "name"},
+		envFrom:   []string{"secretRef", "name"},
+		volume:    []string{"secret", "secretName"},
+		projected: []string{"secret", "name"},
+	},
+}
+
+type renameResult struct {
+	Target     *yaml.RNode
+	OldName    string
+	References []*yaml.RNode
+}
+
+// baseName returns the name of a target without its hash suffix.
+func baseName(target *yaml.RNode) string {
+	if name, ok := target.GetAnnotations()[annotationBaseName]; ok && name != "" {
+		return name
+	}
+	return target.GetName()
+}
+
+func targetID(kind, namespace, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+// hash marks a target to get a hash suffix appended to its name.
+func (i *ConfigMapInjector) hash(id string) {
+	if i.hashed == nil {
+		i.hashed = map[string]bool{}
+	}
+	i.hashed[id] = true
+}
+
+// hashTargets appends a hash of their content to the names of all targets
+// written by a source with hashSuffix enabled, and updates references to
+// those targets in the pod specs of workload resources.
+func (i *ConfigMapInjector) hashTargets(items []*yaml.RNode) error {
+	if len(i.hashed) == 0 {
+		return nil
+	}
+
+	for _, target := range items {
+		kind := target.GetKind()
+		if _, ok := refPaths[kind]; !ok || target.GetApiVersion() != apiVersionConfigMap {
+			continue
+		}
+		name := baseName(target)
+		if !i.hashed[targetID(kind, target.GetNamespace(), name)] {
+			continue
+		}
+
+		oldName := target.GetName()
+		hashed := target.Copy()
+		if err := hashed.SetName(name); err != nil {
+			return err
+		}
+		h := &hasher.Hasher{}
+		hash, err := h.Hash(hashed)
+		if err != nil {
+			return err
+		}
+		newName := fmt.Sprintf("%s-%s", name, hash)
+		if err := target.SetName(newName); err != nil {
+			return err
+		}
+		annotations := target.GetAnnotations()
+		annotations[annotationBaseName] = name
+		if err := target.SetAnnotations(annotations); err != nil {
+			return err
+		}
+
+		result := &renameResult{
+			Target:  target,
+			OldName: oldName,
+		}
+		oldNames := map[string]bool{name: true, oldName: true}
+		for _, item := range items {
+			updated, err := updateReferences(item, kind, target.GetNamespace(), oldNames, newName)
+			if err != nil {
+				return err
+			}
+			if updated {
+				result.References = append(result.References, item)
+			}
+		}
+		// a target whose content is unchanged since the last run keeps its
+		// name, which isn't a rename
+		if newName != oldName {
+			i.renames = append(i.renames, result)
+		}
+	}
+	return nil
+}
+
+// updateReferences renames references to a ConfigMap or Secret in the pod
+// spec of a resource in the given namespace. It returns true if any reference
+// was updated.
+func updateReferences(item *yaml.RNode, kind, namespace string, oldNames map[string]bool, newName string) (bool, error) {
+	if item.GetNamespace() != namespace {
+		return false, nil
+	}
+
+	paths := podSpecPaths
+	if item.GetKind() == "Pod" {
+		paths = [][]string{{"spec"}}
+	}
+
+	updated := false
+	rename := func(node *yaml.RNode, path []string) error {
+		ref, err := node.Pipe(yaml.Lookup(path...))
+		if err != nil || ref == nil {
+			return err
+		}
+		if oldNames[ref.YNode().Value] && ref.YNode().Value != newName {
+			ref.YNode().Value = newName
+			updated = true
+		}
+		return nil
+	}
+	refs := refPaths[kind]
+
+	for _, path := range paths {
+		podSpec, err := item.Pipe(yaml.Lookup(path...))
+		if err != nil {
+			return false, err
+		}
+		if podSpec == nil {
+			continue
+		}
+
+		for _, field := range []string{"containers", "initContainers", "ephemeralContainers"} {
+			err := visitElements(podSpec, []string{field}, func(container *yaml.RNode) error {
+				err := visitElements(container, []string{"env"}, func(env *yaml.RNode) error {
+					return rename(env, refs.env)
+				})
+				if err != nil {
+					return err
+				}
+				return visitElements(container, []string{"envFrom"}, func(envFrom *yaml.RNode) error {
+					return rename(envFrom, refs.envFrom)
+				})
+			})
+			if err != nil {
+				return false, err
+			}
+		}
+
+		err = visitElements(podSpec, []string{"volumes"}, func(volume *yaml.RNode) error {
+			if err := rename(volume, refs.volume); err != nil {
+				return err
+			}
+			return visitElements(volume, []string{"projected", "sources"}, func(source *yaml.RNode) error {
+				return rename(source, refs.projected)
+			})
+		})
+		if err != nil {
+			return false, err
+		}
+	}
+	return updated, nil
+}
+
+func visitElements(node *yaml.RNode, path []string, fn func(*yaml.RNode) error) error {
+	list, err := node.Pipe(yaml.Lookup(path...))
+	if err != nil || list == nil || list.YNode().Kind != yaml.SequenceNode {
+		return err
+	}
+	return list.VisitElements(fn)
+}
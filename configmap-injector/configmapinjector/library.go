@@ -0,0 +1,181 @@
+package configmapinjector
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	kindTemplateLibrary = "ConfigMapTemplateLibrary"
+	funcInclude         = "include"
+)
+
+// parseTemplates parses the data of a template source into a template set,
+// together with the templates defined in all ConfigMapTemplateLibrary
+// resources in items. Each key of the source's data is a template named after
+// the key. References to templates that aren't defined and cyclic references
+// are rejected before rendering.
+func parseTemplates(source *yaml.RNode, items []*yaml.RNode, funcs template.FuncMap) (*template.Template, error) {
+	root := template.New(source.GetName()).Option("missingkey=error")
+
+	var stack []string
+	include := func(name string, data interface{}) (string, error) {
+		for _, included := range stack {
+			if included == name {
+				return "", fmt.Errorf("cyclic include: %s -> %s", strings.Join(stack, " -> "), name)
+			}
+		}
+		stack = append(stack, name)
+		defer func() { stack = stack[:len(stack)-1] }()
+
+		var buf bytes.Buffer
+		err := root.ExecuteTemplate(&buf, name, data)
+		return buf.String(), err
+	}
+	libraryFuncs := template.FuncMap{funcInclude: include}
+	for name, fn := range funcs {
+		libraryFuncs[name] = fn
+	}
+	root.Funcs(libraryFuncs)
+
+	selector := kindSelector(kindTemplateLibrary)
+	libraries, err := selector.Filter(items)
+	if err != nil {
+		return nil, err
+	}
+	definedBy := map[string]string{}
+	for _, library := range libraries {
+		desc := sourceDescription(library)
+		data := library.GetDataMap()
+		for _, key := range yaml.SortedMapKeys(data) {
+			name := fmt.Sprintf("%s/%s", library.GetName(), key)
+			tmpl, err := template.New(name).Funcs(libraryFuncs).Parse(data[key])
+			if err != nil {
+				return nil, fmt.Errorf("%s: data.%s: %w", desc, key, err)
+			}
+			for _, defined := range tmpl.Templates() {
+				if defined.Name() == name {
+					continue
+				}
+				if previous, ok := definedBy[defined.Name()]; ok {
+					return nil, fmt.Errorf(
+						"template %q is defined in both %s and %s",
+						defined.Name(), previous, desc,
+					)
+				}
+				definedBy[defined.Name()] = desc
+				if _, err := root.AddParseTree(defined.Name(), defined.Tree); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	data := source.GetDataMap()
+	for _, key := range yaml.SortedMapKeys(data) {
+		if _, err := root.New(key).Parse(data[key]); err != nil {
+			return nil, &fieldError{Path: "data." + key, Err: err}
+		}
+	}
+
+	if err := checkTemplateReferences(root, data); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// checkTemplateReferences checks that all templates referenced by the data
+// templates, either with the template action or with include, are defined
+// and don't reference themselves.
+func checkTemplateReferences(root *template.Template, data map[string]string) error {
+	refs := map[string][]string{}
+	for _, tmpl := range root.Templates() {
+		if tmpl.Tree != nil {
+			refs[tmpl.Name()] = templateReferences(tmpl.Tree.Root, nil)
+		}
+	}
+
+	var visit func(path []string) error
+	visit = func(path []string) error {
+		name := path[len(path)-1]
+		for _, ref := range refs[name] {
+			if root.Lookup(ref) == nil {
+				return fmt.Errorf(
+					"template %q referenced by %s is not defined",
+					ref, strings.Join(path, " -> "),
+				)
+			}
+			for _, visited := range path {
+				if visited == ref {
+					return fmt.Errorf("cyclic template reference: %s -> %s", strings.Join(path, " -> "), ref)
+				}
+			}
+			if err := visit(append(path[:len(path):len(path)], ref)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, key := range yaml.SortedMapKeys(data) {
+		if err := visit([]string{key}); err != nil {
+			return &fieldError{Path: "data." + key, Err: err}
+		}
+	}
+	return nil
+}
+
+// templateReferences appends the names of the templates referenced by node to
+// refs. Only include calls with a literal name can be checked.
+func templateReferences(node parse.Node, refs []string) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return refs
+		}
+		for _, child := range n.Nodes {
+			refs = templateReferences(child, refs)
+		}
+	case *parse.ActionNode:
+		refs = templateReferences(n.Pipe, refs)
+	case *parse.TemplateNode:
+		refs = append(refs, n.Name)
+		refs = templateReferences(n.Pipe, refs)
+	case *parse.IfNode:
+		refs = templateBranchReferences(&n.BranchNode, refs)
+	case *parse.RangeNode:
+		refs = templateBranchReferences(&n.BranchNode, refs)
+	case *parse.WithNode:
+		refs = templateBranchReferences(&n.BranchNode, refs)
+	case *parse.PipeNode:
+		if n == nil {
+			return refs
+		}
+		for _, cmd := range n.Cmds {
+			refs = templateReferences(cmd, refs)
+		}
+	case *parse.CommandNode:
+		if len(n.Args) > 1 {
+			ident, isIdent := n.Args[0].(*parse.IdentifierNode)
+			name, isString := n.Args[1].(*parse.StringNode)
+			if isIdent && isString && ident.Ident == funcInclude {
+				refs = append(refs, name.Text)
+			}
+		}
+		for _, arg := range n.Args {
+			refs = templateReferences(arg, refs)
+		}
+	}
+	return refs
+}
+
+func templateBranchReferences(n *parse.BranchNode, refs []string) []string {
+	refs = templateReferences(n.Pipe, refs)
+	refs = templateReferences(n.List, refs)
+	return templateReferences(n.ElseList, refs)
+}
@@ -0,0 +1,221 @@
+package configmapinjector
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const defaultMergeKey = "name"
+
+// MergeStrategy controls how an injected value is combined with the value
+// that already exists in the target key.
+type MergeStrategy string
+
+const (
+	// MergeStrategyReplace replaces the existing value.
+	MergeStrategyReplace MergeStrategy = "replace"
+	// MergeStrategyDeepMerge merges maps recursively and replaces lists.
+	MergeStrategyDeepMerge MergeStrategy = "deepMerge"
+	// MergeStrategyStrategicList merges maps recursively and merges lists of
+	// maps by the value of their merge key.
+	MergeStrategyStrategicList MergeStrategy = "strategicList"
+)
+
+func validateMergeStrategy(strategy MergeStrategy) error {
+	switch strategy {
+	case "", MergeStrategyReplace, MergeStrategyDeepMerge, MergeStrategyStrategicList:
+		return nil
+	default:
+		return fmt.Errorf(
+			"unsupported merge strategy %q, must be one of %q, %q or %q",
+			strategy, MergeStrategyReplace, MergeStrategyDeepMerge, MergeStrategyStrategicList,
+		)
+	}
+}
+
+// existingValue returns the current value of a key in a ConfigMap or Secret.
+// Values in the data field of a Secret are decoded.
+func existingValue(target *yaml.RNode, key string) (string, bool, error) {
+	if target.GetKind() != kindSecret {
+		val, ok := target.GetDataMap()[key]
+		return val, ok, nil
+	}
+	stringData, err := getStringData(target)
+	if err != nil {
+		return "", false, err
+	}
+	if val, ok := stringData[key]; ok {
+		return val, true, nil
+	}
+	encoded, ok := target.GetDataMap()[key]
+	if !ok {
+		return "", false, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false, err
+	}
+	return string(decoded), true, nil
+}
+
+// mergeValue merges the source node into the YAML or JSON document embedded
+// in existing and serializes the result in the format and indentation of
+// existing. Comments of the existing document are kept.
+func mergeValue(existing string, node *yaml.RNode, opts KeyOptions, mode CommentMode) (string, error) {
+	dst, err := yaml.Parse(existing)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse existing value: %w", err)
+	}
+	src := node.Copy()
+	if err := src.DeAnchor(); err != nil {
+		return "", err
+	}
+	if mode != CommentsKeep {
+		stripComments(src.YNode())
+	}
+
+	mergeKey := opts.MergeKey
+	if mergeKey == "" {
+		mergeKey = defaultMergeKey
+	}
+	merged := mergeNodes(dst.YNode(), src.YNode(), opts.MergeStrategy, mergeKey)
+
+	var buf bytes.Buffer
+	switch embeddedFormat(existing) {
+	case FormatJSON:
+		err = encodeJSON(&buf, merged)
+	case FormatJSONPretty:
+		var compact bytes.Buffer
+		if err := encodeJSON(&compact, merged); err != nil {
+			return "", err
+		}
+		err = json.Indent(&buf, compact.Bytes(), "", embeddedIndent(existing))
+		if strings.HasSuffix(existing, "\n") {
+			buf.WriteString("\n")
+		}
+	default:
+		style := yaml.SequenceIndentStyle(yaml.DeriveSeqIndentStyle(existing))
+		encoder := yaml.NewEncoderWithOptions(&buf, &yaml.EncoderOptions{SeqIndent: style})
+		if indent := len(embeddedIndent(existing)); indent >= 2 {
+			encoder.SetIndent(indent)
+		}
+		err = encoder.Encode(merged)
+	}
+	return buf.String(), err
+}
+
+// embeddedFormat detects whether an embedded document is YAML, compact JSON
+// or indented JSON.
+func embeddedFormat(doc string) Format {
+	trimmed := strings.TrimSpace(doc)
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return FormatYAML
+	}
+	if strings.Contains(trimmed, "\n") {
+		return FormatJSONPretty
+	}
+	return FormatJSON
+}
+
+// embeddedIndent returns the indentation of the first indented line of an
+// embedded document, two spaces if there is none.
+func embeddedIndent(doc string) string {
+	for _, line := range strings.Split(doc, "\n") {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" || trimmed == line || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		return line[:len(line)-len(trimmed)]
+	}
+	return "  "
+}
+
+// mergeNodes merges src into dst and returns the result. Maps are merged
+// recursively and a null value in src deletes the key from dst. Lists are
+// replaced, unless the strategy is strategicList and both lists contain maps
+// with a merge key, in which case elements with the same merge key are merged
+// and the other elements are appended. A value of src that replaces a value of
+// dst without comments of its own takes over the comments of dst.
+func mergeNodes(dst, src *yaml.Node, strategy MergeStrategy, mergeKey string) *yaml.Node {
+	if dst.Kind == yaml.DocumentNode && len(dst.Content) > 0 {
+		dst.Content[0] = mergeNodes(dst.Content[0], src, strategy, mergeKey)
+		return dst.Content[0]
+	}
+
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, val := src.Content[i], src.Content[i+1]
+			idx := mapIndex(dst, key.Value)
+			switch {
+			case val.Tag == yaml.NodeTagNull:
+				if idx >= 0 {
+					dst.Content = append(dst.Content[:idx], dst.Content[idx+2:]...)
+				}
+			case idx >= 0:
+				dst.Content[idx+1] = mergeNodes(dst.Content[idx+1], val, strategy, mergeKey)
+			default:
+				dst.Content = append(dst.Content, key, val)
+			}
+		}
+		return dst
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode &&
+		strategy == MergeStrategyStrategicList:
+		for _, elem := range src.Content {
+			idx := listIndex(dst, mergeKey, elem)
+			if idx < 0 {
+				dst.Content = append(dst.Content, elem)
+				continue
+			}
+			dst.Content[idx] = mergeNodes(dst.Content[idx], elem, strategy, mergeKey)
+		}
+		return dst
+	default:
+		if src.HeadComment == "" && src.LineComment == "" && src.FootComment == "" {
+			src.HeadComment = dst.HeadComment
+			src.LineComment = dst.LineComment
+			src.FootComment = dst.FootComment
+		}
+		return src
+	}
+}
+
+// mapIndex returns the index of key in the content of a mapping node, or -1.
+func mapIndex(node *yaml.Node, key string) int {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// listIndex returns the index of the element of a sequence node that has the
+// same value for mergeKey as elem, or -1.
+func listIndex(list *yaml.Node, mergeKey string, elem *yaml.Node) int {
+	value := func(node *yaml.Node) (string, bool) {
+		if node.Kind != yaml.MappingNode {
+			return "", false
+		}
+		idx := mapIndex(node, mergeKey)
+		if idx < 0 || node.Content[idx+1].Kind != yaml.ScalarNode {
+			return "", false
+		}
+		return node.Content[idx+1].Value, true
+	}
+	want, ok := value(elem)
+	if !ok {
+		return -1
+	}
+	for i, node := range list.Content {
+		if got, ok := value(node); ok && got == want {
+			return i
+		}
+	}
+	return -1
+}
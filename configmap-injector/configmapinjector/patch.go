@@ -0,0 +1,466 @@
+package configmapinjector
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	kindPatch        = "ConfigMapPatch"
+	fieldOperations  = "operations"
+	jsonPointerEnd   = "-"
+	jsonPointerSlash = "/"
+)
+
+// PatchOp is the type of a ConfigMapPatch operation.
+type PatchOp string
+
+const (
+	// PatchOpJSONPatch applies an RFC 6902 JSON Patch to a key holding a YAML
+	// or JSON document.
+	PatchOpJSONPatch PatchOp = "jsonPatch"
+	// PatchOpMergePatch applies an RFC 7386 JSON merge patch to a key holding
+	// a YAML or JSON document.
+	PatchOpMergePatch PatchOp = "mergePatch"
+	// PatchOpRename renames a key.
+	PatchOpRename PatchOp = "rename"
+	// PatchOpDelete deletes a key.
+	PatchOpDelete PatchOp = "delete"
+	// PatchOpRegexReplace replaces all matches of a regular expression in the
+	// value of a key.
+	PatchOpRegexReplace PatchOp = "regexReplace"
+)
+
+// PatchOperation is an operation of a ConfigMapPatch.
+type PatchOperation struct {
+	Op          PatchOp   `json:"op" yaml:"op"`
+	Key         string    `json:"key" yaml:"key"`
+	To          string    `json:"to,omitempty" yaml:"to,omitempty"`
+	Patch       yaml.Node `json:"patch,omitempty" yaml:"patch,omitempty"`
+	Pattern     string    `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Replacement string    `json:"replacement,omitempty" yaml:"replacement,omitempty"`
+}
+
+type jsonPatchOperation struct {
+	Op    string    `yaml:"op"`
+	Path  string    `yaml:"path"`
+	From  string    `yaml:"from,omitempty"`
+	Value yaml.Node `yaml:"value,omitempty"`
+	// SkipIfPresent skips an add to the end of a list (/-) if the list
+	// already holds the value. It is an extension of RFC 6902.
+	SkipIfPresent bool `yaml:"skipIfPresent,omitempty"`
+}
+
+type patchResult struct {
+	Source    *yaml.RNode
+	Target    *yaml.RNode
+	Index     int
+	Operation PatchOperation
+	// Reason is set when the operation didn't change the target
+	Reason string
+}
+
+func (r *patchResult) message() string {
+	desc := fmt.Sprintf(
+		"%s %s: %s of key %q",
+		r.Source.GetKind(), r.Source.GetName(), r.Operation.Op, r.Operation.Key,
+	)
+	if r.Reason != "" {
+		return fmt.Sprintf("%s not applied to %s: %s", desc, r.Target.GetName(), r.Reason)
+	}
+	return fmt.Sprintf("%s applied to %s", desc, r.Target.GetName())
+}
+
+// getPatchOperations returns the operations of a ConfigMapPatch.
+func getPatchOperations(source *yaml.RNode) ([]PatchOperation, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldOperations))
+	if err != nil {
+		return nil, err
+	}
+	if node == nil || node.YNode().Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("%s must be a list", fieldOperations)
+	}
+	yamlstr, err := node.String()
+	if err != nil {
+		return nil, err
+	}
+	var operations []PatchOperation
+	if err := yaml.Unmarshal([]byte(yamlstr), &operations); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %s: %w", fieldOperations, err)
+	}
+	for idx, op := range operations {
+		if op.Key == "" {
+			return nil, fmt.Errorf("%s[%d]: key is required", fieldOperations, idx)
+		}
+		switch op.Op {
+		case PatchOpJSONPatch, PatchOpMergePatch:
+			if op.Patch.Kind == 0 {
+				return nil, fmt.Errorf("%s[%d]: patch is required for %s", fieldOperations, idx, op.Op)
+			}
+		case PatchOpRename:
+			if op.To == "" {
+				return nil, fmt.Errorf("%s[%d]: to is required for %s", fieldOperations, idx, op.Op)
+			}
+		case PatchOpRegexReplace:
+			if op.Pattern == "" {
+				return nil, fmt.Errorf("%s[%d]: pattern is required for %s", fieldOperations, idx, op.Op)
+			}
+		case PatchOpDelete:
+		default:
+			return nil, fmt.Errorf(
+				"%s[%d]: unsupported op %q, must be one of %q, %q, %q, %q or %q",
+				fieldOperations, idx, op.Op,
+				PatchOpJSONPatch, PatchOpMergePatch, PatchOpRename, PatchOpDelete, PatchOpRegexReplace,
+			)
+		}
+	}
+	return operations, nil
+}
+
+// patchData applies the operations of a ConfigMapPatch to its target.
+func (i *ConfigMapInjector) patchData(_ *renderContext, source *yaml.RNode, target *yaml.RNode) (*yaml.RNode, *injectResult, error) {
+	result := newInjectResult(source, target)
+	defer func() {
+		i.injectResults = append(i.injectResults, result)
+	}()
+
+	operations, err := getPatchOperations(source)
+	if err != nil {
+		result.fail(err)
+		return target, result, err
+	}
+
+	changed := map[string]bool{}
+	for idx, op := range operations {
+		reason, err := applyPatchOperation(target, op)
+		if err != nil {
+			err = &fieldError{
+				Path: fmt.Sprintf("%s[%d]", fieldOperations, idx),
+				Err:  fmt.Errorf("%s of key %q: %w", op.Op, op.Key, err),
+			}
+			result.fail(err)
+			return target, result, err
+		}
+		if reason == "" {
+			changed[op.Key] = true
+			if op.Op == PatchOpRename {
+				changed[op.To] = true
+			}
+		}
+		i.patches = append(i.patches, &patchResult{
+			Source:    source,
+			Target:    target,
+			Index:     idx,
+			Operation: op,
+			Reason:    reason,
+		})
+	}
+	for key := range changed {
+		result.Keys = append(result.Keys, key)
+	}
+	sort.Strings(result.Keys)
+	return target, result, nil
+}
+
+// applyPatchOperation applies a single operation to the data of a ConfigMap.
+// It returns the reason if the operation didn't change the target.
+func applyPatchOperation(target *yaml.RNode, op PatchOperation) (string, error) {
+	data := target.GetDataMap()
+	val, ok := data[op.Key]
+
+	switch op.Op {
+	case PatchOpDelete:
+		if !ok {
+			return "key not found", nil
+		}
+		return "", deleteKeys(target, []string{op.Key})
+	case PatchOpRename:
+		// a key renamed on an earlier run is already in place, or injected
+		// again with the same value
+		existing, exists := data[op.To]
+		switch {
+		case !ok && exists:
+			return "already renamed", nil
+		case !ok:
+			return "key not found", nil
+		case exists && existing != val:
+			return "", fmt.Errorf("key %q already exists", op.To)
+		}
+		data[op.To] = val
+		delete(data, op.Key)
+		target.SetDataMap(data)
+		return "", nil
+	}
+
+	if !ok {
+		return "", fmt.Errorf("key not found")
+	}
+
+	var patched string
+	switch op.Op {
+	case PatchOpRegexReplace:
+		re, err := regexp.Compile(op.Pattern)
+		if err != nil {
+			return "", err
+		}
+		if !re.MatchString(val) {
+			return "pattern not found", nil
+		}
+		patched = re.ReplaceAllString(val, op.Replacement)
+	default:
+		doc, err := yaml.Parse(val)
+		if err != nil {
+			return "", fmt.Errorf("unable to parse value: %w", err)
+		}
+		var node *yaml.Node
+		if op.Op == PatchOpMergePatch {
+			node = mergeNodes(doc.YNode(), &op.Patch, MergeStrategyDeepMerge, "")
+		} else {
+			node, err = applyJSONPatch(doc.YNode(), &op.Patch)
+			if err != nil {
+				return "", err
+			}
+		}
+		patched, err = encode(embeddedFormat(val), CommentsKeep, yaml.NewRNode(node))
+		if err != nil {
+			return "", err
+		}
+	}
+	if patched == val {
+		return "value unchanged", nil
+	}
+	data[op.Key] = patched
+	target.SetDataMap(data)
+	return "", nil
+}
+
+// applyJSONPatch applies an RFC 6902 JSON Patch to a YAML node, keeping the
+// order of map keys and comments.
+func applyJSONPatch(doc, patch *yaml.Node) (*yaml.Node, error) {
+	var operations []jsonPatchOperation
+	if err := patch.Decode(&operations); err != nil {
+		return nil, fmt.Errorf("unable to decode patch: %w", err)
+	}
+
+	// the document is wrapped in a map with an empty key so that the root can
+	// be addressed like any other value
+	root := &yaml.Node{
+		Kind:    yaml.MappingNode,
+		Content: []*yaml.Node{yaml.NewStringRNode("").YNode(), doc},
+	}
+	for idx, op := range operations {
+		if err := applyJSONPatchOperation(root, op); err != nil {
+			return nil, fmt.Errorf("patch[%d]: %s %s: %w", idx, op.Op, op.Path, err)
+		}
+	}
+	if len(root.Content) != 2 {
+		return nil, fmt.Errorf("patch removes the whole document")
+	}
+	return root.Content[1], nil
+}
+
+func applyJSONPatchOperation(root *yaml.Node, op jsonPatchOperation) error {
+	value := func() (*yaml.Node, error) {
+		if op.Value.Kind == 0 {
+			return nil, fmt.Errorf("value is required")
+		}
+		return yaml.NewRNode(&op.Value).Copy().YNode(), nil
+	}
+
+	switch op.Op {
+	case "add":
+		val, err := value()
+		if err != nil {
+			return err
+		}
+		// with skipIfPresent, patching the output of an earlier run doesn't
+		// append the value again
+		if op.SkipIfPresent && strings.HasSuffix(op.Path, jsonPointerSlash+jsonPointerEnd) {
+			list, err := jsonPointerGet(root, strings.TrimSuffix(op.Path, jsonPointerSlash+jsonPointerEnd))
+			if err != nil {
+				return err
+			}
+			found, err := containsNode(list, val)
+			if err != nil || found {
+				return err
+			}
+		}
+		return jsonPointerAdd(root, op.Path, val)
+	case "remove":
+		_, err := jsonPointerRemove(root, op.Path)
+		return err
+	case "replace":
+		val, err := value()
+		if err != nil {
+			return err
+		}
+		if _, err := jsonPointerRemove(root, op.Path); err != nil {
+			return err
+		}
+		return jsonPointerAdd(root, op.Path, val)
+	case "move":
+		val, err := jsonPointerRemove(root, op.From)
+		if err != nil {
+			return err
+		}
+		return jsonPointerAdd(root, op.Path, val)
+	case "copy":
+		val, err := jsonPointerGet(root, op.From)
+		if err != nil {
+			return err
+		}
+		return jsonPointerAdd(root, op.Path, yaml.NewRNode(val).Copy().YNode())
+	case "test":
+		want, err := value()
+		if err != nil {
+			return err
+		}
+		got, err := jsonPointerGet(root, op.Path)
+		if err != nil {
+			return err
+		}
+		var gotVal, wantVal interface{}
+		if err := got.Decode(&gotVal); err != nil {
+			return err
+		}
+		if err := want.Decode(&wantVal); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(gotVal, wantVal) {
+			return fmt.Errorf("test failed")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported op %q", op.Op)
+	}
+}
+
+// containsNode returns whether a list holds an item equal to val.
+func containsNode(list, val *yaml.Node) (bool, error) {
+	if list.Kind != yaml.SequenceNode {
+		return false, nil
+	}
+	var want interface{}
+	if err := val.Decode(&want); err != nil {
+		return false, err
+	}
+	for _, item := range list.Content {
+		var got interface{}
+		if err := item.Decode(&got); err != nil {
+			return false, err
+		}
+		if reflect.DeepEqual(got, want) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// jsonPointerParent resolves all but the last token of a JSON pointer
+// relative to the wrapped root. It returns the parent node and the last
+// token.
+func jsonPointerParent(root *yaml.Node, pointer string) (*yaml.Node, string, error) {
+	if pointer != "" && !strings.HasPrefix(pointer, jsonPointerSlash) {
+		return nil, "", fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := []string{""}
+	if pointer != "" {
+		for _, token := range strings.Split(pointer[1:], jsonPointerSlash) {
+			token = strings.ReplaceAll(token, "~1", "/")
+			tokens = append(tokens, strings.ReplaceAll(token, "~0", "~"))
+		}
+	}
+
+	node := root
+	for _, token := range tokens[:len(tokens)-1] {
+		child, _, err := jsonPointerChild(node, token)
+		if err != nil {
+			return nil, "", err
+		}
+		node = child
+	}
+	return node, tokens[len(tokens)-1], nil
+}
+
+// jsonPointerChild returns the child of a node addressed by a JSON pointer
+// token, and its index in the node's content.
+func jsonPointerChild(node *yaml.Node, token string) (*yaml.Node, int, error) {
+	switch node.Kind {
+	case yaml.MappingNode:
+		idx := mapIndex(node, token)
+		if idx < 0 {
+			return nil, 0, fmt.Errorf("key %q not found", token)
+		}
+		return node.Content[idx+1], idx, nil
+	case yaml.SequenceNode:
+		idx, err := strconv.Atoi(token)
+		if err != nil || idx < 0 || idx >= len(node.Content) {
+			return nil, 0, fmt.Errorf("index %q out of range", token)
+		}
+		return node.Content[idx], idx, nil
+	default:
+		return nil, 0, fmt.Errorf("cannot address %q in a scalar value", token)
+	}
+}
+
+func jsonPointerGet(root *yaml.Node, pointer string) (*yaml.Node, error) {
+	parent, token, err := jsonPointerParent(root, pointer)
+	if err != nil {
+		return nil, err
+	}
+	child, _, err := jsonPointerChild(parent, token)
+	return child, err
+}
+
+func jsonPointerAdd(root *yaml.Node, pointer string, val *yaml.Node) error {
+	parent, token, err := jsonPointerParent(root, pointer)
+	if err != nil {
+		return err
+	}
+	switch parent.Kind {
+	case yaml.MappingNode:
+		if idx := mapIndex(parent, token); idx >= 0 {
+			parent.Content[idx+1] = val
+			return nil
+		}
+		parent.Content = append(parent.Content, yaml.NewStringRNode(token).YNode(), val)
+		return nil
+	case yaml.SequenceNode:
+		idx := len(parent.Content)
+		if token != jsonPointerEnd {
+			idx, err = strconv.Atoi(token)
+			if err != nil || idx < 0 || idx > len(parent.Content) {
+				return fmt.Errorf("index %q out of range", token)
+			}
+		}
+		parent.Content = append(parent.Content, nil)
+		copy(parent.Content[idx+1:], parent.Content[idx:])
+		parent.Content[idx] = val
+		return nil
+	default:
+		return fmt.Errorf("cannot add %q to a scalar value", token)
+	}
+}
+
+func jsonPointerRemove(root *yaml.Node, pointer string) (*yaml.Node, error) {
+	parent, token, err := jsonPointerParent(root, pointer)
+	if err != nil {
+		return nil, err
+	}
+	child, idx, err := jsonPointerChild(parent, token)
+	if err != nil {
+		return nil, err
+	}
+	if parent.Kind == yaml.MappingNode {
+		parent.Content = append(parent.Content[:idx], parent.Content[idx+2:]...)
+	} else {
+		parent.Content = append(parent.Content[:idx], parent.Content[idx+1:]...)
+	}
+	return child, nil
+}
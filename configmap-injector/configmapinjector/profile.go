@@ -0,0 +1,102 @@
+package configmapinjector
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	fieldEnabled  = "enabled"
+	fieldProfiles = "profiles"
+)
+
+// profileFields are the fields of a source a profile can override.
+var profileFields = []string{fieldEnabled, yaml.DataField, fieldValues}
+
+// sourceEnabled returns whether a source is enabled. Sources are enabled
+// unless their enabled field is false.
+func sourceEnabled(source *yaml.RNode) (bool, error) {
+	return sourceBool(source, fieldEnabled, true)
+}
+
+// applyProfile returns the source with the enabled and data fields of the
+// given profile applied. Data keys of the profile replace the keys of the
+// source, and a null key removes it. The source is returned unchanged if it
+// doesn't have the profile. Profile values are applied by templateValues.
+func applyProfile(source *yaml.RNode, profile string) (*yaml.RNode, error) {
+	overlay, err := getProfile(source, profile)
+	if err != nil || overlay == nil {
+		return source, err
+	}
+
+	source = source.Copy()
+	if enabled := overlay.Field(fieldEnabled); enabled != nil {
+		if err := source.PipeE(yaml.SetField(fieldEnabled, enabled.Value)); err != nil {
+			return nil, err
+		}
+	}
+	if data := overlay.Field(yaml.DataField); data != nil {
+		if data.Value.YNode().Kind != yaml.MappingNode {
+			return nil, fmt.Errorf(
+				"%s %s: %s.%s.%s must be a map",
+				source.GetKind(), source.GetName(), fieldProfiles, profile, yaml.DataField,
+			)
+		}
+		node, err := source.Pipe(yaml.LookupCreate(yaml.MappingNode, yaml.DataField))
+		if err != nil {
+			return nil, err
+		}
+		mergeNodes(node.YNode(), data.Value.YNode(), MergeStrategyDeepMerge, "")
+	}
+	return source, nil
+}
+
+// getProfile returns the overlay of the given profile of a source, or nil if
+// the source doesn't have it.
+func getProfile(source *yaml.RNode, profile string) (*yaml.RNode, error) {
+	if profile == "" {
+		return nil, nil
+	}
+	overlay, err := source.Pipe(yaml.Lookup(fieldProfiles, profile))
+	if err != nil || overlay == nil {
+		return nil, err
+	}
+	if overlay.YNode().Kind != yaml.MappingNode {
+		return nil, fmt.Errorf(
+			"%s %s: %s.%s must be a map",
+			source.GetKind(), source.GetName(), fieldProfiles, profile,
+		)
+	}
+	fields, err := overlay.Fields()
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range fields {
+		supported := false
+		for _, f := range profileFields {
+			supported = supported || field == f
+		}
+		if !supported {
+			return nil, fmt.Errorf(
+				"%s %s: %s.%s.%s: unsupported field, must be one of %v",
+				source.GetKind(), source.GetName(), fieldProfiles, profile, field, profileFields,
+			)
+		}
+	}
+	return overlay, nil
+}
+
+// profileValues returns the values of the active profile of a template
+// source.
+func (i *ConfigMapInjector) profileValues(source *yaml.RNode) (map[string]interface{}, error) {
+	overlay, err := getProfile(source, i.Profile)
+	if err != nil || overlay == nil {
+		return nil, err
+	}
+	values, err := getValues(overlay)
+	if err != nil {
+		return nil, fmt.Errorf("%s.%s: %w", fieldProfiles, i.Profile, err)
+	}
+	return values, nil
+}
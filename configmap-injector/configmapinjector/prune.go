@@ -0,0 +1,143 @@
+package configmapinjector
+
+import (
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// annotationManagedKeys records the keys of a target that were written by the
+// function, so that keys no source provides anymore can be pruned on the next
+// run.
+const annotationManagedKeys = annotationPrefixFn + "managed-keys"
+
+type pruneResult struct {
+	Target *yaml.RNode
+	Keys   []string
+}
+
+// pruneTargets removes the keys that were written to a target on a previous
+// run but aren't provided by any source anymore, and records the keys created
+// on this run in the managed-keys annotation. Keys that were already in the
+// input target, like the keys of an upstream ConfigMap, are never managed, even
+// if a source overwrites or merges into them, so they are left alone.
+func (i *ConfigMapInjector) pruneTargets(items []*yaml.RNode) error {
+	for _, target := range items {
+		kind := target.GetKind()
+		if _, ok := refPaths[kind]; !ok || target.GetApiVersion() != apiVersionConfigMap {
+			continue
+		}
+
+		annotations := target.GetAnnotations()
+		managed, tracked := annotations[annotationManagedKeys]
+		owners, touched := i.owners[targetID(kind, target.GetNamespace(), baseName(target))]
+		if !tracked && !touched {
+			continue
+		}
+
+		var stale []string
+		for _, key := range strings.Split(managed, ",") {
+			if _, ok := owners[key]; key != "" && !ok {
+				stale = append(stale, key)
+			}
+		}
+		if len(stale) > 0 {
+			if err := deleteKeys(target, stale); err != nil {
+				return err
+			}
+			i.prunes = append(i.prunes, &pruneResult{
+				Target: target,
+				Keys:   stale,
+			})
+			i.recordPrune(target, stale)
+		}
+
+		previous := map[string]bool{}
+		for _, key := range strings.Split(managed, ",") {
+			previous[key] = true
+		}
+		input := i.inputValues[targetID(kind, target.GetNamespace(), baseName(target))]
+		keys := make([]string, 0, len(owners))
+		for key := range owners {
+			if _, existed := input[key]; !existed || previous[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			annotations[annotationManagedKeys] = strings.Join(keys, ",")
+		} else {
+			delete(annotations, annotationManagedKeys)
+		}
+		if err := target.SetAnnotations(annotations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inputValues returns the values of the ConfigMaps and Secrets in the input,
+// by target id.
+func inputValues(items []*yaml.RNode) (map[string]map[string]string, error) {
+	values := map[string]map[string]string{}
+	for _, item := range items {
+		kind := item.GetKind()
+		if _, ok := refPaths[kind]; !ok || item.GetApiVersion() != apiVersionConfigMap {
+			continue
+		}
+		vals, err := targetValues(item)
+		if err != nil {
+			return nil, err
+		}
+		values[targetID(kind, item.GetNamespace(), baseName(item))] = vals
+	}
+	return values, nil
+}
+
+// managedOnly returns whether all keys of a target were written by the
+// function on an earlier run, as is the case for the targets it generated.
+func managedOnly(target *yaml.RNode) (bool, error) {
+	managed, ok := target.GetAnnotations()[annotationManagedKeys]
+	if !ok {
+		return false, nil
+	}
+	keys := map[string]bool{}
+	for _, key := range strings.Split(managed, ",") {
+		keys[key] = true
+	}
+	values, err := targetValues(target)
+	if err != nil {
+		return false, err
+	}
+	for key := range values {
+		if !keys[key] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// deleteKeys removes keys from all data fields of a ConfigMap or Secret.
+func deleteKeys(target *yaml.RNode, keys []string) error {
+	for _, field := range []string{yaml.DataField, yaml.BinaryDataField, fieldStringData} {
+		node, err := target.Pipe(yaml.Lookup(field))
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			continue
+		}
+		for _, key := range keys {
+			if _, err := node.Pipe(yaml.Clear(key)); err != nil {
+				return err
+			}
+		}
+		if len(node.Content()) == 0 {
+			if err := target.PipeE(yaml.Clear(field)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package configmapinjector
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	fieldValuesSchema = "valuesSchema"
+	layerValuesSchema = "valuesSchema defaults"
+)
+
+// Schema is the subset of JSON Schema supported by valuesSchema.
+type Schema struct {
+	Type       string             `json:"type,omitempty" yaml:"type,omitempty"`
+	Properties map[string]*Schema `json:"properties,omitempty" yaml:"properties,omitempty"`
+	Items      *Schema            `json:"items,omitempty" yaml:"items,omitempty"`
+	Required   []string           `json:"required,omitempty" yaml:"required,omitempty"`
+	Default    interface{}        `json:"default,omitempty" yaml:"default,omitempty"`
+	Enum       []interface{}      `json:"enum,omitempty" yaml:"enum,omitempty"`
+	Pattern    string             `json:"pattern,omitempty" yaml:"pattern,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaError is a value that doesn't match its schema.
+type schemaError struct {
+	Source  *yaml.RNode
+	Path    string
+	Message string
+}
+
+var schemaTypes = []string{"string", "integer", "number", "boolean", "object", "array", "null"}
+
+// getValuesSchema returns the valuesSchema of a template source, or nil if the
+// source doesn't have one.
+func getValuesSchema(source *yaml.RNode) (*Schema, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldValuesSchema))
+	if err != nil || node == nil {
+		return nil, err
+	}
+	yamlstr, err := node.String()
+	if err != nil {
+		return nil, err
+	}
+	schema := &Schema{}
+	if err := yaml.Unmarshal([]byte(yamlstr), schema); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %s: %w", fieldValuesSchema, err)
+	}
+	if schema.Type == "" && len(schema.Properties) > 0 {
+		schema.Type = "object"
+	}
+	if err := schema.compile(fieldValuesSchema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// compile checks the schema and compiles its patterns.
+func (s *Schema) compile(path string) error {
+	if s.Type != "" {
+		valid := false
+		for _, t := range schemaTypes {
+			valid = valid || s.Type == t
+		}
+		if !valid {
+			return fmt.Errorf("%s.type: unsupported type %q, must be one of %v", path, s.Type, schemaTypes)
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("%s.pattern: %w", path, err)
+		}
+		s.pattern = re
+	}
+	for name, prop := range s.Properties {
+		if prop == nil {
+			return fmt.Errorf("%s.properties.%s: schema must be a map", path, name)
+		}
+		if err := prop.compile(fmt.Sprintf("%s.properties.%s", path, name)); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		return s.Items.compile(path + ".items")
+	}
+	return nil
+}
+
+// applyDefaults sets the default of every property missing from val and
+// records them in origins. It returns val with the defaults applied.
+func (s *Schema) applyDefaults(val interface{}, path string, origins map[string]string) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for _, name := range sortedSchemaKeys(s.Properties) {
+			prop := s.Properties[name]
+			propPath := joinPath(path, name)
+			if current, ok := v[name]; ok && current != nil {
+				v[name] = prop.applyDefaults(current, propPath, origins)
+				continue
+			}
+			if prop.Default != nil {
+				v[name] = prop.Default
+				origins[propPath] = layerValuesSchema
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for idx, elem := range v {
+				v[idx] = s.Items.applyDefaults(elem, fmt.Sprintf("%s[%d]", path, idx), origins)
+			}
+		}
+	}
+	return val
+}
+
+// validate returns the errors of val, which is at the given path. The
+// messages don't include val, which may be a secret.
+func (s *Schema) validate(val interface{}, path string) []*schemaError {
+	fail := func(format string, args ...interface{}) []*schemaError {
+		return []*schemaError{{
+			Path:    path,
+			Message: fmt.Sprintf(format, args...),
+		}}
+	}
+
+	if s.Type != "" && !hasSchemaType(val, s.Type) {
+		return fail("must be of type %s, got %s", s.Type, schemaType(val))
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, allowed := range s.Enum {
+			found = found || reflect.DeepEqual(normalizeNumber(allowed), normalizeNumber(val))
+		}
+		if !found {
+			return fail("must be one of %v", s.Enum)
+		}
+	}
+	if str, ok := val.(string); ok && s.pattern != nil && !s.pattern.MatchString(str) {
+		return fail("must match pattern %q", s.Pattern)
+	}
+
+	var errs []*schemaError
+	switch v := val.(type) {
+	case map[string]interface{}:
+		missing := map[string]bool{}
+		for _, name := range s.Required {
+			if current, ok := v[name]; !ok || current == nil || current == "" {
+				missing[name] = true
+				errs = append(errs, &schemaError{
+					Path:    joinPath(path, name),
+					Message: "is required",
+				})
+			}
+		}
+		for _, name := range sortedSchemaKeys(s.Properties) {
+			if current, ok := v[name]; ok && current != nil && !missing[name] {
+				errs = append(errs, s.Properties[name].validate(current, joinPath(path, name))...)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for idx, elem := range v {
+				errs = append(errs, s.Items.validate(elem, fmt.Sprintf("%s[%d]", path, idx))...)
+			}
+		}
+	}
+	return errs
+}
+
+func hasSchemaType(val interface{}, t string) bool {
+	switch t {
+	case "integer":
+		switch v := normalizeNumber(val).(type) {
+		case float64:
+			return v == float64(int64(v))
+		default:
+			return false
+		}
+	case "number":
+		_, ok := normalizeNumber(val).(float64)
+		return ok
+	default:
+		return schemaType(val) == t
+	}
+}
+
+func schemaType(val interface{}) string {
+	switch normalizeNumber(val).(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	default:
+		return fmt.Sprintf("%T", val)
+	}
+}
+
+// normalizeNumber converts all numeric types to float64 so that values decoded
+// from YAML can be compared regardless of their Go type.
+func normalizeNumber(val interface{}) interface{} {
+	switch v := val.(type) {
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case uint64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	default:
+		return val
+	}
+}
+
+func joinPath(prefix, name string) string {
+	switch {
+	case prefix == "":
+		return name
+	case name == "":
+		return prefix
+	}
+	return prefix + "." + name
+}
+
+func sortedSchemaKeys(m map[string]*Schema) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
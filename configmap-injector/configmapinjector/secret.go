@@ -0,0 +1,119 @@
+package configmapinjector
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	kindSecretInject   = "SecretInject"
+	kindSecretTemplate = "SecretTemplate"
+	kindSecret         = "Secret"
+	fieldDataField     = "dataField"
+	fieldSecretType    = "type"
+	fieldStringData    = "stringData"
+	defaultSecretType  = "Opaque"
+	secretTemplate     = `apiVersion: v1
+kind: Secret
+metadata:
+  name: secret
+`
+)
+
+// secretDataField returns the Secret field a source writes to: "data" (the
+// default, base64 encoded) or "stringData".
+func secretDataField(source *yaml.RNode) (string, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldDataField))
+	if err != nil {
+		return "", err
+	}
+	if node == nil || node.YNode().Value == "" {
+		return yaml.DataField, nil
+	}
+	switch field := node.YNode().Value; field {
+	case yaml.DataField, fieldStringData:
+		return field, nil
+	default:
+		return "", fmt.Errorf(
+			"%s %s: %s must be %q or %q, got %q",
+			source.GetKind(), source.GetName(), fieldDataField,
+			yaml.DataField, fieldStringData, field,
+		)
+	}
+}
+
+// secretType returns the type of the Secret a source generates.
+func secretType(source *yaml.RNode) (string, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldSecretType))
+	if err != nil {
+		return "", err
+	}
+	if node == nil || node.YNode().Value == "" {
+		return defaultSecretType, nil
+	}
+	return node.YNode().Value, nil
+}
+
+// setSecretData writes data into the data or stringData field of a Secret,
+// removing the same keys from the other field so that a key is only set
+// once.
+func setSecretData(source, secret *yaml.RNode, data map[string]string) error {
+	field, err := secretDataField(source)
+	if err != nil {
+		return err
+	}
+
+	encoded := secret.GetDataMap()
+	stringData, err := getStringData(secret)
+	if err != nil {
+		return err
+	}
+	for key, val := range data {
+		if field == fieldStringData {
+			stringData[key] = val
+			delete(encoded, key)
+		} else {
+			encoded[key] = base64.StdEncoding.EncodeToString([]byte(val))
+			delete(stringData, key)
+		}
+	}
+
+	secret.SetDataMap(encoded)
+	return setStringData(secret, stringData)
+}
+
+func getStringData(secret *yaml.RNode) (map[string]string, error) {
+	result := map[string]string{}
+	node, err := secret.Pipe(yaml.Lookup(fieldStringData))
+	if err != nil || node == nil {
+		return result, err
+	}
+	err = node.VisitFields(func(node *yaml.MapNode) error {
+		result[yaml.GetValue(node.Key)] = yaml.GetValue(node.Value)
+		return nil
+	})
+	return result, err
+}
+
+func setStringData(secret *yaml.RNode, stringData map[string]string) error {
+	if err := secret.PipeE(yaml.Clear(fieldStringData)); err != nil {
+		return err
+	}
+	for _, key := range yaml.SortedMapKeys(stringData) {
+		node := yaml.NewStringRNode(stringData[key])
+		if strings.Contains(stringData[key], "\n") {
+			node.YNode().Style = yaml.LiteralStyle
+		}
+		err := secret.PipeE(
+			yaml.LookupCreate(yaml.MappingNode, fieldStringData),
+			yaml.SetField(key, node),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,406 @@
+package configmapinjector
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/kyaml/fn/runtime/runtimeutil"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	fieldTargetMetadata = "targetMetadata"
+	fieldBehavior       = "behavior"
+	fieldTarget         = "target"
+	fieldTargets        = "targets"
+	fieldNamespaceMatch = "namespaceMatching"
+	annotationPrefixFn  = "fn.kumorilabs.io/"
+
+	// annotationOutputPath sets the file generated targets of a source are
+	// written to, relative to the package
+	annotationOutputPath = annotationPrefixFn + "output-path"
+)
+
+// Behavior controls how a source treats an existing target, similar to the
+// behavior of Kustomize's configMapGenerator.
+type Behavior string
+
+const (
+	// BehaviorCreate fails if the target already exists.
+	BehaviorCreate Behavior = "create"
+	// BehaviorReplace discards the existing data of the target.
+	BehaviorReplace Behavior = "replace"
+	// BehaviorMerge merges keys into the target, generating it if it doesn't
+	// exist.
+	BehaviorMerge Behavior = "merge"
+	// BehaviorMustExist merges keys into the target and fails if it doesn't
+	// exist.
+	BehaviorMustExist Behavior = "mustExist"
+)
+
+// NamespaceMatching controls how the namespace of a target selected by name
+// is matched against the namespace of existing targets.
+type NamespaceMatching string
+
+const (
+	// NamespaceMatchingExact only matches targets in the same namespace.
+	NamespaceMatchingExact NamespaceMatching = "exact"
+	// NamespaceMatchingSourceDefaultsToTarget lets a source without a
+	// namespace match a target in any namespace, like a target whose
+	// namespace was set by set-namespace. A source with a namespace only
+	// matches targets in the same namespace.
+	NamespaceMatchingSourceDefaultsToTarget NamespaceMatching = "sourceDefaultsToTarget"
+	// NamespaceMatchingIgnore matches targets by name only.
+	NamespaceMatchingIgnore NamespaceMatching = "ignore"
+)
+
+// functionAnnotations are annotations that only have meaning on the source
+// resources and must not be copied to generated ConfigMaps.
+var functionAnnotations = []string{
+	konfig.IgnoredByKustomizeAnnotation,
+	runtimeutil.FunctionAnnotationKey,
+	"config.k8s.io/function",
+	kioutil.IdAnnotation,
+	kioutil.LegacyIdAnnotation,
+}
+
+// fileAnnotations are the annotations recording the file of a resource. They
+// are set on generated targets by setFileAnnotations.
+var fileAnnotations = []string{
+	kioutil.PathAnnotation,
+	kioutil.IndexAnnotation,
+	kioutil.LegacyPathAnnotation,
+	kioutil.LegacyIndexAnnotation,
+}
+
+// TargetMetadata is metadata applied to the target ConfigMap of a source.
+type TargetMetadata struct {
+	Namespace   string            `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+}
+
+// TargetRef selects the targets of a source, either by name or with a label
+// selector. Targets selected by labels must already exist. Path is the file a
+// target selected by name is written to if it is generated.
+type TargetRef struct {
+	Name          string `json:"name,omitempty" yaml:"name,omitempty"`
+	Namespace     string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	LabelSelector string `json:"labelSelector,omitempty" yaml:"labelSelector,omitempty"`
+	Path          string `json:"path,omitempty" yaml:"path,omitempty"`
+}
+
+// getTargetRefs returns the targets of a source. The target or targets fields
+// take precedence over the source's own name and namespace. The namespace of a
+// target selected by name defaults to the namespace of the source, and its
+// path to the output-path annotation of the source; a label selector without a
+// namespace matches targets in all namespaces.
+func getTargetRefs(source *yaml.RNode, meta *TargetMetadata) ([]TargetRef, error) {
+	namespace := targetNamespace(source, meta)
+	outputPath := source.GetAnnotations()[annotationOutputPath]
+	target, err := source.Pipe(yaml.Lookup(fieldTarget))
+	if err != nil {
+		return nil, err
+	}
+	targets, err := source.Pipe(yaml.Lookup(fieldTargets))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		refs  []TargetRef
+		field = fieldTargets
+	)
+	switch {
+	case target != nil && targets != nil:
+		return nil, fmt.Errorf(
+			"%s %s: %s and %s are mutually exclusive",
+			source.GetKind(), source.GetName(), fieldTarget, fieldTargets,
+		)
+	case target != nil:
+		ref := TargetRef{}
+		if err := target.YNode().Decode(&ref); err != nil {
+			return nil, fmt.Errorf("%s %s: unable to decode %s: %w", source.GetKind(), source.GetName(), fieldTarget, err)
+		}
+		refs = []TargetRef{ref}
+		field = fieldTarget
+	case targets != nil:
+		if err := targets.YNode().Decode(&refs); err != nil {
+			return nil, fmt.Errorf("%s %s: unable to decode %s: %w", source.GetKind(), source.GetName(), fieldTargets, err)
+		}
+	default:
+		return []TargetRef{{Name: source.GetName(), Namespace: namespace, Path: outputPath}}, nil
+	}
+
+	for idx := range refs {
+		ref := &refs[idx]
+		path := field
+		if field == fieldTargets {
+			path = fmt.Sprintf("%s[%d]", field, idx)
+		}
+		if (ref.Name == "") == (ref.LabelSelector == "") {
+			return nil, fmt.Errorf(
+				"%s %s: %s: exactly one of name or labelSelector is required",
+				source.GetKind(), source.GetName(), path,
+			)
+		}
+		if ref.LabelSelector != "" && ref.Path != "" {
+			return nil, fmt.Errorf(
+				"%s %s: %s: path only applies to targets selected by name",
+				source.GetKind(), source.GetName(), path,
+			)
+		}
+		if ref.Name != "" && ref.Namespace == "" {
+			ref.Namespace = namespace
+		}
+		if ref.Name != "" && ref.Path == "" {
+			ref.Path = outputPath
+		}
+	}
+	return refs, nil
+}
+
+// getTargetMetadata returns the optional targetMetadata of a source, or nil if
+// the source doesn't have one.
+func getTargetMetadata(source *yaml.RNode) (*TargetMetadata, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldTargetMetadata))
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, nil
+	}
+	yamlstr, err := node.String()
+	if err != nil {
+		return nil, err
+	}
+	meta := &TargetMetadata{}
+	if err := yaml.Unmarshal([]byte(yamlstr), meta); err != nil {
+		return nil, fmt.Errorf(
+			"%s %s: unable to unmarshal %s: %w",
+			source.GetKind(), source.GetName(), fieldTargetMetadata, err,
+		)
+	}
+	return meta, nil
+}
+
+// sourceBehavior returns the behavior of a source, merge by default.
+func sourceBehavior(source *yaml.RNode) (Behavior, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldBehavior))
+	if err != nil {
+		return "", err
+	}
+	if node == nil || node.YNode().Value == "" {
+		return BehaviorMerge, nil
+	}
+	switch behavior := Behavior(node.YNode().Value); behavior {
+	case BehaviorCreate, BehaviorReplace, BehaviorMerge, BehaviorMustExist:
+		return behavior, nil
+	default:
+		return "", fmt.Errorf(
+			"%s %s: %s must be one of %q, %q, %q or %q, got %q",
+			source.GetKind(), source.GetName(), fieldBehavior,
+			BehaviorCreate, BehaviorReplace, BehaviorMerge, BehaviorMustExist, behavior,
+		)
+	}
+}
+
+// sourceNamespaceMatching returns the namespace matching mode of a source,
+// which defaults to the mode of the function config.
+func sourceNamespaceMatching(source *yaml.RNode, defaultMode NamespaceMatching) (NamespaceMatching, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldNamespaceMatch))
+	if err != nil {
+		return "", err
+	}
+	if node == nil || node.YNode().Value == "" {
+		if defaultMode == "" {
+			return NamespaceMatchingExact, nil
+		}
+		return defaultMode, nil
+	}
+	mode := NamespaceMatching(node.YNode().Value)
+	if err := validateNamespaceMatching(mode); err != nil {
+		return "", fmt.Errorf("%s %s: %w", source.GetKind(), source.GetName(), err)
+	}
+	return mode, nil
+}
+
+func validateNamespaceMatching(mode NamespaceMatching) error {
+	switch mode {
+	case "", NamespaceMatchingExact, NamespaceMatchingSourceDefaultsToTarget, NamespaceMatchingIgnore:
+		return nil
+	default:
+		return fmt.Errorf(
+			"%s must be one of %q, %q or %q, got %q",
+			fieldNamespaceMatch, NamespaceMatchingExact, NamespaceMatchingSourceDefaultsToTarget,
+			NamespaceMatchingIgnore, mode,
+		)
+	}
+}
+
+// matchNamespace returns the indexes of the targets in namespace, out of the
+// candidates with the right name, according to the matching mode. Matching
+// more than one target in different namespaces is an error.
+func matchNamespace(mode NamespaceMatching, namespace string, items []*yaml.RNode, candidates []int) ([]int, error) {
+	var exact, other []int
+	for _, idx := range candidates {
+		if items[idx].GetNamespace() == namespace {
+			exact = append(exact, idx)
+		} else {
+			other = append(other, idx)
+		}
+	}
+
+	var matches []int
+	switch mode {
+	case NamespaceMatchingSourceDefaultsToTarget:
+		matches = exact
+		if len(exact) == 0 && namespace == "" {
+			matches = other
+		}
+	case NamespaceMatchingIgnore:
+		matches = append(exact, other...)
+	default:
+		return exact, nil
+	}
+
+	namespaces := map[string]string{}
+	for _, idx := range matches {
+		namespace := items[idx].GetNamespace()
+		namespaces[namespace] = namespace
+	}
+	if len(namespaces) > 1 {
+		return nil, fmt.Errorf(
+			"matches %d targets in namespaces %q (%s: %s)",
+			len(matches), yaml.SortedMapKeys(namespaces), fieldNamespaceMatch, mode,
+		)
+	}
+	return matches, nil
+}
+
+// targetPath returns the file a generated target is written to: the path of
+// its ref, or a file named after the kind and name of the target next to the
+// source, like configmap_app-config.yaml.
+func targetPath(source *yaml.RNode, ref TargetRef, kind string) (string, error) {
+	if ref.Path != "" {
+		p := path.Clean(ref.Path)
+		if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return "", fmt.Errorf(
+				"%s %s: output path %q must be relative to the package",
+				source.GetKind(), source.GetName(), ref.Path,
+			)
+		}
+		return p, nil
+	}
+	sourcePath, _, err := kioutil.GetFileAnnotations(source)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("%s_%s.yaml", strings.ToLower(kind), ref.Name)
+	return path.Join(path.Dir(sourcePath), name), nil
+}
+
+// setFileAnnotations sets the path and index annotations of a generated
+// target, placing it after the resources of items already in the same file.
+func setFileAnnotations(target *yaml.RNode, items []*yaml.RNode, filePath string) error {
+	index := 0
+	for _, item := range items {
+		p, i, err := kioutil.GetFileAnnotations(item)
+		if err != nil {
+			return err
+		}
+		if n, err := strconv.Atoi(i); err == nil && p == filePath && n >= index {
+			index = n + 1
+		}
+	}
+	annotations := target.GetAnnotations()
+	for _, key := range []string{kioutil.PathAnnotation, kioutil.LegacyPathAnnotation} {
+		annotations[key] = filePath
+	}
+	for _, key := range []string{kioutil.IndexAnnotation, kioutil.LegacyIndexAnnotation} {
+		annotations[key] = strconv.Itoa(index)
+	}
+	return target.SetAnnotations(annotations)
+}
+
+// clearData removes all keys from the data fields of a target except for the
+// given keys.
+func clearData(target *yaml.RNode, keep map[string]*yaml.RNode) error {
+	var keys []string
+	for _, field := range []string{yaml.DataField, yaml.BinaryDataField, fieldStringData} {
+		node, err := target.Pipe(yaml.Lookup(field))
+		if err != nil {
+			return err
+		}
+		if node == nil {
+			continue
+		}
+		fields, err := node.Fields()
+		if err != nil {
+			return err
+		}
+		for _, key := range fields {
+			if _, ok := keep[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return deleteKeys(target, keys)
+}
+
+// targetNamespace returns the namespace of the target ConfigMap of a source.
+// The targetMetadata namespace takes precedence over the source's namespace.
+func targetNamespace(source *yaml.RNode, meta *TargetMetadata) string {
+	if meta != nil && meta.Namespace != "" {
+		return meta.Namespace
+	}
+	return source.GetNamespace()
+}
+
+// applyTargetMetadata merges the labels and annotations of meta into target.
+func applyTargetMetadata(target *yaml.RNode, meta *TargetMetadata) error {
+	if meta == nil {
+		return nil
+	}
+	if len(meta.Labels) > 0 {
+		labels := target.GetLabels()
+		for k, v := range meta.Labels {
+			labels[k] = v
+		}
+		if err := target.SetLabels(labels); err != nil {
+			return err
+		}
+	}
+	if len(meta.Annotations) > 0 {
+		annotations := target.GetAnnotations()
+		for k, v := range meta.Annotations {
+			annotations[k] = v
+		}
+		if err := target.SetAnnotations(annotations); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inheritedAnnotations returns the annotations of a source that should be
+// copied to a generated ConfigMap.
+func inheritedAnnotations(source *yaml.RNode) map[string]string {
+	annotations := source.GetAnnotations()
+	for _, key := range functionAnnotations {
+		delete(annotations, key)
+	}
+	for _, key := range fileAnnotations {
+		delete(annotations, key)
+	}
+	for key := range annotations {
+		if strings.HasPrefix(key, annotationPrefixFn) {
+			delete(annotations, key)
+		}
+	}
+	return annotations
+}
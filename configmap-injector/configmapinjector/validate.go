@@ -0,0 +1,188 @@
+package configmapinjector
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const fieldValidate = "validate"
+
+// Validation checks the content of a key after it is rendered or serialized.
+// It is either the name of a format, or a schema that the content, parsed as
+// YAML or JSON, must match:
+//
+//	validate: json
+//	validate:
+//	  schema:
+//	    type: object
+type Validation struct {
+	Format Format  `json:"format,omitempty" yaml:"format,omitempty"`
+	Schema *Schema `json:"schema,omitempty" yaml:"schema,omitempty"`
+}
+
+// validationFormats are the formats content can be validated as.
+var validationFormats = []Format{FormatJSON, FormatYAML, FormatTOML, FormatProperties}
+
+// UnmarshalYAML accepts the name of a format as well as a map.
+func (v *Validation) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		v.Format = Format(node.Value)
+		return nil
+	}
+	type validation Validation
+	return node.Decode((*validation)(v))
+}
+
+func (v *Validation) compile(path string) error {
+	if v.Schema != nil {
+		if v.Format != "" {
+			return fmt.Errorf("%s: format and schema are mutually exclusive", path)
+		}
+		return v.Schema.compile(path + ".schema")
+	}
+	for _, f := range validationFormats {
+		if v.Format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: unsupported format %q, must be one of %v or a schema", path, v.Format, validationFormats)
+}
+
+// validateData validates the content of all keys that have a validation.
+func validateData(data map[string]string, options map[string]KeyOptions) error {
+	for _, key := range yaml.SortedMapKeys(data) {
+		validation := options[key].Validate
+		if validation == nil {
+			continue
+		}
+		if err := validation.validate(data[key]); err != nil {
+			return &fieldError{Path: "data." + key, Err: err}
+		}
+	}
+	return nil
+}
+
+func (v *Validation) validate(content string) error {
+	if v.Schema != nil {
+		var val interface{}
+		if err := yaml.Unmarshal([]byte(content), &val); err != nil {
+			return fmt.Errorf("invalid yaml: %w", err)
+		}
+		errs := v.Schema.validate(val, "")
+		if len(errs) == 0 {
+			return nil
+		}
+		msgs := make([]string, 0, len(errs))
+		for _, schemaErr := range errs {
+			msgs = append(msgs, strings.TrimSpace(schemaErr.Path+" "+schemaErr.Message))
+		}
+		return fmt.Errorf("doesn't match schema: %s", strings.Join(msgs, ", "))
+	}
+
+	var err error
+	switch v.Format {
+	case FormatJSON:
+		err = validateJSON(content)
+	case FormatYAML:
+		var val interface{}
+		err = yaml.Unmarshal([]byte(content), &val)
+	case FormatTOML:
+		var val interface{}
+		_, err = toml.Decode(content, &val)
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			err = fmt.Errorf("line %d: %s", parseErr.Line, parseErr.Message)
+		}
+	case FormatProperties:
+		err = validateProperties(content)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", v.Format, err)
+	}
+	return nil
+}
+
+// validateJSON checks that content is a single JSON value and reports the
+// line and column of syntax errors.
+func validateJSON(content string) error {
+	var val interface{}
+	err := json.Unmarshal([]byte(content), &val)
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		line, column := position(content, syntaxErr.Offset)
+		return fmt.Errorf("line %d, column %d: %s", line, column, syntaxErr.Error())
+	}
+	return err
+}
+
+// position returns the line and column of the byte before offset, which is
+// where encoding/json detected the error.
+func position(content string, offset int64) (int, int) {
+	line, column := 1, 0
+	for i, r := range content {
+		if int64(i) >= offset {
+			break
+		}
+		if r == '\n' {
+			line++
+			column = 0
+			continue
+		}
+		column++
+	}
+	return line, column
+}
+
+// continues returns true if a properties line ends with an odd number of
+// backslashes, which continues it on the next line.
+func continues(line string) bool {
+	n := len(line) - len(strings.TrimRight(line, `\`))
+	return n%2 == 1
+}
+
+// validateProperties checks that content is a valid Java .properties file:
+// every logical line has a key and unicode escapes are well-formed.
+func validateProperties(content string) error {
+	lines := strings.Split(content, "\n")
+	for idx := 0; idx < len(lines); idx++ {
+		lineNo := idx + 1
+		line := strings.TrimLeft(lines[idx], " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		if line[0] == '=' || line[0] == ':' {
+			return fmt.Errorf("line %d: missing key", lineNo)
+		}
+		// join continuation lines
+		for continues(line) {
+			idx++
+			if idx >= len(lines) {
+				return fmt.Errorf("line %d: continuation at end of file", lineNo)
+			}
+			line = line[:len(line)-1] + strings.TrimLeft(lines[idx], " \t\f")
+		}
+		for i := 0; i < len(line); i++ {
+			if line[i] != '\\' {
+				continue
+			}
+			i++
+			if i < len(line) && line[i] == 'u' {
+				if len(line)-i-1 < 4 {
+					return fmt.Errorf("line %d: malformed \\uxxxx escape", lineNo)
+				}
+				for _, c := range line[i+1 : i+5] {
+					if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+						return fmt.Errorf("line %d: malformed \\uxxxx escape", lineNo)
+					}
+				}
+				i += 4
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package configmapinjector
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const (
+	kindTemplateValues  = "TemplateValues"
+	fieldValues         = "values"
+	fieldValuesFrom     = "valuesFrom"
+	fieldTemplateValues = "templateValues"
+	layerFunctionConfig = "function config"
+)
+
+// ValueFrom sets a template value from a field of another resource.
+type ValueFrom struct {
+	// Name is the name of the template value.
+	Name string `json:"name" yaml:"name"`
+	// Resource selects the resource. The namespace defaults to the
+	// namespace of the source.
+	Resource yaml.ResourceIdentifier `json:"resource" yaml:"resource"`
+	// FieldPath is the path to the field, like spec.ports[0].port or
+	// spec.rules[host=example.com].http.
+	FieldPath string `json:"fieldPath" yaml:"fieldPath"`
+}
+
+// templateValues returns the values used to render a template source and the
+// layer that supplied each value, keyed by its dotted path. The layers are
+// deep merged, from lowest to highest precedence: the values of all
+// ConfigMapTemplateLibrary resources, the TemplateValues referenced by the
+// source in order, the source's values, the values of its active profile, its
+// valuesFrom, the values of the function config and the current forEach
+// element.
+func (i *ConfigMapInjector) templateValues(ctx *renderContext, source *yaml.RNode) (map[string]interface{}, map[string]string, error) {
+	values := map[string]interface{}{}
+	origins := map[string]string{}
+
+	selector := kindSelector(kindTemplateLibrary)
+	libraries, err := selector.Filter(ctx.items)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, library := range libraries {
+		defaults, err := getValues(library)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s %s: %w", library.GetKind(), library.GetName(), err)
+		}
+		mergeValues(values, defaults, "", fmt.Sprintf("%s %s", library.GetKind(), library.GetName()), origins)
+	}
+
+	shared, err := i.sharedValues(ctx, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, node := range shared {
+		layer, err := getValues(node)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s %s: %w", node.GetKind(), node.GetName(), err)
+		}
+		mergeValues(values, layer, "", fmt.Sprintf("%s %s", node.GetKind(), node.GetName()), origins)
+	}
+
+	local, err := getValues(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	mergeValues(values, local, "", fieldValues, origins)
+
+	profile, err := i.profileValues(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	mergeValues(values, profile, "", fmt.Sprintf("%s.%s", fieldProfiles, i.Profile), origins)
+
+	valuesFrom, err := resolveValuesFrom(source, ctx.items)
+	if err != nil {
+		return nil, nil, err
+	}
+	mergeValues(values, valuesFrom, "", fieldValuesFrom, origins)
+
+	mergeValues(values, i.Values, "", layerFunctionConfig, origins)
+	if ctx.element != nil {
+		mergeValues(values, ctx.element.Values, "", fmt.Sprintf("%s[%d]", fieldForEach, ctx.element.Index), origins)
+	}
+	return values, origins, nil
+}
+
+// sharedValues returns the TemplateValues resources referenced by a template
+// source, in the namespace of the source.
+func (i *ConfigMapInjector) sharedValues(ctx *renderContext, source *yaml.RNode) ([]*yaml.RNode, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldTemplateValues))
+	if err != nil || node == nil {
+		return nil, err
+	}
+	var names []string
+	if err := node.YNode().Decode(&names); err != nil {
+		return nil, fmt.Errorf("%s must be a list of names: %w", fieldTemplateValues, err)
+	}
+
+	selector := kindSelector(kindTemplateValues)
+	candidates, err := selector.Filter(ctx.items)
+	if err != nil {
+		return nil, err
+	}
+	var shared []*yaml.RNode
+	for idx, name := range names {
+		var found *yaml.RNode
+		for _, candidate := range candidates {
+			if candidate.GetName() == name && candidate.GetNamespace() == source.GetNamespace() {
+				found = candidate
+				break
+			}
+		}
+		if found == nil {
+			return nil, &fieldError{
+				Path: fmt.Sprintf("%s[%d]", fieldTemplateValues, idx),
+				Err:  fmt.Errorf("%s %s not found", kindTemplateValues, name),
+			}
+		}
+		shared = append(shared, found)
+	}
+	return shared, nil
+}
+
+// mergeValues deep merges src into dst. Maps are merged recursively, any other
+// value replaces the value in dst. The layer is recorded in origins for every
+// value it sets, replacing the origins of the values it overrides.
+func mergeValues(dst, src map[string]interface{}, prefix, layer string, origins map[string]string) {
+	for key, val := range src {
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+		srcMap, srcIsMap := val.(map[string]interface{})
+		dstMap, dstIsMap := dst[key].(map[string]interface{})
+		if srcIsMap && len(srcMap) > 0 {
+			if !dstIsMap {
+				dstMap = map[string]interface{}{}
+				dst[key] = dstMap
+				clearOrigins(origins, path)
+			}
+			mergeValues(dstMap, srcMap, path, layer, origins)
+			continue
+		}
+		dst[key] = val
+		clearOrigins(origins, path)
+		origins[path] = layer
+	}
+}
+
+// clearOrigins removes the origins of a value and all values nested in it.
+func clearOrigins(origins map[string]string, path string) {
+	delete(origins, path)
+	for key := range origins {
+		if strings.HasPrefix(key, path+".") {
+			delete(origins, key)
+		}
+	}
+}
+
+// getValues returns the literal values of a template source.
+func getValues(source *yaml.RNode) (map[string]interface{}, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldValues))
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	if node == nil {
+		return values, nil
+	}
+	if node.YNode().Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s must be a map", fieldValues)
+	}
+	if err := node.YNode().Decode(&values); err != nil {
+		return nil, fmt.Errorf("unable to decode %s: %w", fieldValues, err)
+	}
+	return values, nil
+}
+
+// getValuesFrom returns the valuesFrom references of a template source.
+func getValuesFrom(source *yaml.RNode) ([]ValueFrom, error) {
+	node, err := source.Pipe(yaml.Lookup(fieldValuesFrom))
+	if err != nil || node == nil {
+		return nil, err
+	}
+	yamlstr, err := node.String()
+	if err != nil {
+		return nil, err
+	}
+	var valuesFrom []ValueFrom
+	if err := yaml.Unmarshal([]byte(yamlstr), &valuesFrom); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %s: %w", fieldValuesFrom, err)
+	}
+	for idx, ref := range valuesFrom {
+		switch {
+		case ref.Name == "":
+			return nil, fmt.Errorf("%s[%d]: name is required", fieldValuesFrom, idx)
+		case ref.Resource.Kind == "" || ref.Resource.Name == "":
+			return nil, fmt.Errorf("%s[%d]: resource kind and name are required", fieldValuesFrom, idx)
+		case ref.FieldPath == "":
+			return nil, fmt.Errorf("%s[%d]: fieldPath is required", fieldValuesFrom, idx)
+		}
+	}
+	return valuesFrom, nil
+}
+
+// resolveValuesFrom returns the values referenced by the valuesFrom list of a
+// template source, looking up the resources in items.
+func resolveValuesFrom(source *yaml.RNode, items []*yaml.RNode) (map[string]interface{}, error) {
+	valuesFrom, err := getValuesFrom(source)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]interface{}{}
+	for idx, ref := range valuesFrom {
+		val, err := resolveValueFrom(source, items, ref)
+		if err != nil {
+			return nil, &fieldError{Path: fmt.Sprintf("%s[%d]", fieldValuesFrom, idx), Err: err}
+		}
+		values[ref.Name] = val
+	}
+	return values, nil
+}
+
+func resolveValueFrom(source *yaml.RNode, items []*yaml.RNode, ref ValueFrom) (interface{}, error) {
+	namespace := ref.Resource.Namespace
+	if namespace == "" {
+		namespace = source.GetNamespace()
+	}
+	desc := fmt.Sprintf("%s %s", ref.Resource.Kind, ref.Resource.Name)
+	if namespace != "" {
+		desc = fmt.Sprintf("%s %s/%s", ref.Resource.Kind, namespace, ref.Resource.Name)
+	}
+
+	var matches []*yaml.RNode
+	for _, item := range items {
+		if item.GetKind() != ref.Resource.Kind ||
+			item.GetName() != ref.Resource.Name ||
+			item.GetNamespace() != namespace {
+			continue
+		}
+		if ref.Resource.APIVersion != "" && item.GetApiVersion() != ref.Resource.APIVersion {
+			continue
+		}
+		matches = append(matches, item)
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("%s not found", desc)
+	case 1:
+	default:
+		return nil, fmt.Errorf("%s matches %d resources, set resource.apiVersion", desc, len(matches))
+	}
+
+	path, err := splitFieldPath(ref.FieldPath)
+	if err != nil {
+		return nil, err
+	}
+	node, err := matches[0].Pipe(yaml.Lookup(path...))
+	if err != nil {
+		return nil, fmt.Errorf("fieldPath %s in %s: %w", ref.FieldPath, desc, err)
+	}
+	if node == nil {
+		return nil, fmt.Errorf("fieldPath %s not found in %s", ref.FieldPath, desc)
+	}
+	var val interface{}
+	if err := node.YNode().Decode(&val); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// splitFieldPath splits a field path like spec.ports[0].port or
+// spec.rules[host=example.com].http into the parts understood by
+// yaml.Lookup. Dots inside brackets don't separate parts.
+func splitFieldPath(fieldPath string) ([]string, error) {
+	var (
+		parts   []string
+		current strings.Builder
+		bracket bool
+	)
+	flush := func() {
+		if current.Len() > 0 {
+			parts = append(parts, current.String())
+			current.Reset()
+		}
+	}
+	for _, r := range fieldPath {
+		switch {
+		case r == '[' && !bracket:
+			flush()
+			bracket = true
+		case r == ']' && bracket:
+			part := current.String()
+			current.Reset()
+			bracket = false
+			if !strings.Contains(part, "=") {
+				// a list index like [0]
+				parts = append(parts, part)
+				continue
+			}
+			parts = append(parts, "["+part+"]")
+		case r == '.' && !bracket:
+			flush()
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if bracket {
+		return nil, fmt.Errorf("invalid fieldPath %q: unclosed bracket", fieldPath)
+	}
+	flush()
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("invalid fieldPath %q", fieldPath)
+	}
+	return parts, nil
+}
@@ -13,8 +13,8 @@ func main() {
 	p := ConfigMapInjectorProcessor{}
 	cmd := command.Build(&p, command.StandaloneEnabled, false)
 
-	cmd.Short = "Inject files wrapped in KRM resources into ConfigMap keys"
-	cmd.Long = "Inject files or templates wrapped in KRM resources into ConfigMap keys"
+	cmd.Short = "Inject files wrapped in KRM resources into ConfigMap and Secret keys"
+	cmd.Long = "Inject files or templates wrapped in KRM resources into ConfigMap and Secret keys"
 
 	if err := cmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -25,9 +25,7 @@ func main() {
 type ConfigMapInjectorProcessor struct{}
 
 func (p *ConfigMapInjectorProcessor) Process(resourceList *framework.ResourceList) error {
-	injector := &configmapinjector.ConfigMapInjector{}
-
-	items, err := injector.Filter(resourceList.Items)
+	injector, err := configmapinjector.New(resourceList.FunctionConfig)
 	if err != nil {
 		resourceList.Results = framework.Results{
 			&framework.Result{
@@ -37,7 +35,10 @@ func (p *ConfigMapInjectorProcessor) Process(resourceList *framework.ResourceLis
 		}
 		return resourceList.Results
 	}
-	resourceList.Items = items
+
+	// Filter keeps going when a source fails and reports every failure in the
+	// results, so the results are returned even when it fails
+	items, filterErr := injector.Filter(resourceList.Items)
 
 	results, err := injector.Results()
 	if err != nil {
@@ -50,5 +51,16 @@ func (p *ConfigMapInjectorProcessor) Process(resourceList *framework.ResourceLis
 		return resourceList.Results
 	}
 	resourceList.Results = results
+
+	if filterErr != nil {
+		if results.ExitCode() == 0 {
+			resourceList.Results = append(resourceList.Results, &framework.Result{
+				Message:  filterErr.Error(),
+				Severity: framework.Error,
+			})
+		}
+		return resourceList.Results
+	}
+	resourceList.Items = items
 	return nil
 }
@@ -3,6 +3,9 @@ module github.com/kumorilabs/kpt-functions
 go 1.14
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/Masterminds/sprig/v3 v3.2.2
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/pomerium/pomerium v0.16.3
 	github.com/stretchr/testify v1.7.0
 	sigs.k8s.io/kustomize/api v0.10.1